@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// 非同期match. 全員に同じquizを出し、各自が期限までに自分のペースで回答する.
+// 各参加者の回答はPracticeSessionで行い(/api/v1/practice/:id/answer)、制限時間はserverで判定する.
+// 全員が解き終えるか期限を過ぎたら、結果をまとめてmatchの結果として保存する.
+
+const (
+	asyncMatchKind       = "AsyncMatch"
+	asyncMatchIDBytes    = 16
+	defaultAsyncDuration = 3 * 24 * time.Hour
+	maxAsyncDuration     = 30 * 24 * time.Hour
+	maxAsyncPlayers      = 100
+	// 期限を過ぎたmatchをまとめる間隔
+	asyncSweepInterval = time.Minute
+)
+
+// AsyncMatch -
+type AsyncMatch struct {
+	ID           string    `json:"id" datastore:"-"` // keyのname
+	Host         string    `json:"host"`
+	Players      []string  `json:"players"` // 招待したuser.ID. 空なら誰でも参加できる
+	TimeLimitSec int       `json:"time_limit_sec" datastore:",noindex"`
+	Deadline     time.Time `json:"deadline"`
+	CreatedAt    time.Time `json:"created_at"`
+	Finished     bool      `json:"finished"` // 結果をまとめた
+	Quizzes      []*Quiz   `json:"-" datastore:"-"`
+	// 途中でquizが編集されても同じ問題を出すため本体ごとjsonで保存する
+	Detail []byte `json:"-" datastore:",noindex"`
+}
+
+func (m *AsyncMatch) resultID() string {
+	return resultModeAsync + "-" + m.ID
+}
+
+// canPlay reports whether user can take part in the match.
+func (m *AsyncMatch) canPlay(userID string) bool {
+	return len(m.Players) == 0 || containsString(m.Players, userID)
+}
+
+type asyncConfig struct {
+	QuizNum      int        `json:"quiz_num"`
+	QuizIDs      []string   `json:"quiz_ids"`
+	Tags         []string   `json:"tags"`
+	Difficulties []string   `json:"difficulties"`
+	TimeLimitSec int        `json:"time_limit_sec"` // 1問あたりの制限時間. 0は無制限
+	Deadline     *time.Time `json:"deadline"`       // 省略時は3日後
+	Players      []string   `json:"players"`
+}
+
+func readAsyncConfig(r *http.Request) (*asyncConfig, error) {
+	defer r.Body.Close()
+	var cfg asyncConfig
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, newAPIError(errCodeInvalidRequest, err.Error())
+	}
+	// quizの選び方と制限時間はlive matchと同じ規則で検証する
+	mc := &MatchConfig{QuizNum: cfg.QuizNum, QuizIDs: cfg.QuizIDs, Tags: cfg.Tags, Difficulties: cfg.Difficulties, TimeLimitSec: cfg.TimeLimitSec}
+	mc.setDefaults()
+	if err := mc.validate(); err != nil {
+		return nil, err
+	}
+	cfg.QuizNum = mc.QuizNum
+
+	now := time.Now()
+	if cfg.Deadline == nil {
+		deadline := now.Add(defaultAsyncDuration)
+		cfg.Deadline = &deadline
+	}
+	if !cfg.Deadline.After(now) || cfg.Deadline.Sub(now) > maxAsyncDuration {
+		return nil, newAPIError(errCodeInvalidConfig, "deadline must be within 30 days from now")
+	}
+	if len(cfg.Players) > maxAsyncPlayers {
+		return nil, newAPIError(errCodeInvalidConfig, "players must be at most 100")
+	}
+	for _, id := range cfg.Players {
+		if id == "" {
+			return nil, newAPIError(errCodeInvalidConfig, "player id must not be empty")
+		}
+	}
+	return &cfg, nil
+}
+
+// asyncView is match as seen by the user. 結果がまとまるまで他の参加者の回答は見せない.
+type asyncView struct {
+	*AsyncMatch
+	QuizNum    int           `json:"quiz_num"`
+	Attempt    *practiceView `json:"attempt"` // まだ参加していなければnil
+	ResultsURL string        `json:"results_url,omitempty"`
+	ReviewURL  string        `json:"review_url,omitempty"`
+}
+
+// CreateAsync creates async match with quizzes picked now.
+func (ph *PracticeHandler) CreateAsync(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	cfg, err := readAsyncConfig(r)
+	if err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: err})
+		return
+	}
+	quizzes, err := ph.qh.PickupFromStorage(r.Context(), &PickupInput{Max: cfg.QuizNum, IDs: cfg.QuizIDs, Tags: cfg.Tags, Difficulties: cfg.Difficulties})
+	if apiErr, ok := err.(*apiError); ok {
+		fail(w, http.StatusUnprocessableEntity, &apiResponse{Err: apiErr})
+		return
+	}
+	if err != nil {
+		ph.logger.Error("async pickup", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	if len(quizzes) == 0 {
+		fail(w, http.StatusUnprocessableEntity, &apiResponse{Err: newAPIError(errCodeNotEnoughQuiz, "no quiz matched the config")})
+		return
+	}
+	id, err := randomHex(asyncMatchIDBytes)
+	if err != nil {
+		ph.logger.Error("async id", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+
+	m := &AsyncMatch{
+		ID:           id,
+		Host:         user.ID,
+		Players:      cfg.Players,
+		TimeLimitSec: cfg.TimeLimitSec,
+		Deadline:     *cfg.Deadline,
+		CreatedAt:    time.Now(),
+		Quizzes:      quizzes,
+	}
+	if m.Detail, err = json.Marshal(quizzes); err != nil {
+		ph.logger.Error("async encode", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	if _, err := ph.datastore.Put(r.Context(), datastore.NameKey(asyncMatchKind, id, nil), m); err != nil {
+		ph.logger.Error("async save", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	ph.logger.Info("async match created", zap.String("id", id), zap.String("host", user.ID), zap.Time("deadline", m.Deadline))
+	w.WriteHeader(http.StatusCreated)
+	(&apiResponse{Data: &asyncView{AsyncMatch: m, QuizNum: len(quizzes)}}).write(w)
+}
+
+// GetAsync returns match and user's attempt. 期限を過ぎていれば結果をまとめる.
+func (ph *PracticeHandler) GetAsync(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	m, err := ph.fetchAsync(r.Context(), params.ByName("id"))
+	// 招待されていないmatchは存在を知られないように404にする
+	if err == datastore.ErrNoSuchEntity || (err == nil && m.Host != user.ID && !m.canPlay(user.ID)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ph.logger.Error("async fetch", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	if !m.Finished && time.Now().After(m.Deadline) {
+		if err := ph.finishAsync(r.Context(), m.ID); err != nil {
+			ph.logger.Error("async finish", zap.Error(err))
+		} else {
+			m.Finished = true
+		}
+	}
+
+	v := &asyncView{AsyncMatch: m, QuizNum: len(m.Quizzes)}
+	s, err := ph.fetch(r.Context(), userSessionID(m.ID, user.ID))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		ph.logger.Error("async attempt", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	if err == nil {
+		v.Attempt = s.view()
+		if m.Finished {
+			v.Attempt.Score = s.score()
+		}
+	}
+	if m.Finished {
+		v.ResultsURL = "/api/v1/match/" + m.resultID() + "/results"
+		v.ReviewURL = "/match/" + m.resultID() + "/review"
+	}
+	(&apiResponse{Data: v}).write(w)
+}
+
+// PlayAsync starts or resumes user's attempt and shows current quiz.
+// 制限時間を過ぎたquizはとばし、次のquizの時間を数え始める.
+func (ph *PracticeHandler) PlayAsync(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	m, err := ph.fetchAsync(r.Context(), params.ByName("id"))
+	if err == datastore.ErrNoSuchEntity || (err == nil && m.Host != user.ID && !m.canPlay(user.ID)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ph.logger.Error("async fetch", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	if !m.canPlay(user.ID) {
+		fail(w, http.StatusForbidden, &apiResponse{Err: newAPIError(errCodeNotParticipant, "only invited players can play")})
+		return
+	}
+	now := time.Now()
+	if m.Finished || now.After(m.Deadline) {
+		fail(w, http.StatusConflict, &apiResponse{Err: newAPIError(errCodeQuizClosed, "match is already over")})
+		return
+	}
+
+	var s *PracticeSession
+	k := datastore.NameKey(practiceKind, userSessionID(m.ID, user.ID), nil)
+	_, err = ph.datastore.RunInTransaction(r.Context(), func(tx *datastore.Transaction) error {
+		s = &PracticeSession{}
+		err := tx.Get(k, s)
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			s = &PracticeSession{
+				UserID:       user.ID,
+				StartedAt:    now,
+				Async:        m.ID,
+				ClosesAt:     m.Deadline,
+				TimeLimitSec: m.TimeLimitSec,
+				User:         user,
+				Quizzes:      m.Quizzes,
+				Results:      make([]QuizResult, len(m.Quizzes)),
+			}
+		case err != nil:
+			return err
+		default:
+			if err := s.decodeDetail(); err != nil {
+				return err
+			}
+		}
+		s.ID = k.Name
+		s.expire(now)
+		s.show(now)
+		if err := s.encodeDetail(); err != nil {
+			return err
+		}
+		_, err = tx.Put(k, s)
+		return err
+	})
+	if err != nil {
+		ph.logger.Error("async play", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	// 最後のquizが時間切れになって解き終えた場合
+	if s.finished() {
+		go ph.finishAsyncIfDone(m.ID)
+	}
+	(&apiResponse{Data: s.view()}).write(w)
+}
+
+func (ph *PracticeHandler) fetchAsync(ctx context.Context, id string) (*AsyncMatch, error) {
+	var m AsyncMatch
+	if err := ph.datastore.Get(ctx, datastore.NameKey(asyncMatchKind, id, nil), &m); err != nil {
+		return nil, err
+	}
+	m.ID = id
+	return &m, json.Unmarshal(m.Detail, &m.Quizzes)
+}
+
+func (ph *PracticeHandler) asyncSessions(ctx context.Context, matchID string) ([]*PracticeSession, error) {
+	var sessions []*PracticeSession
+	keys, err := ph.datastore.GetAll(ctx, datastore.NewQuery(practiceKind).Filter("Async =", matchID), &sessions)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		sessions[i].ID = k.Name
+		if err := sessions[i].decodeDetail(); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+// finishAsyncIfDone finishes match when every invited player has finished.
+// 招待なしのmatchは後から参加する人がいるかもしれないので期限まで待つ.
+func (ph *PracticeHandler) finishAsyncIfDone(matchID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), matchSaveTimeout)
+	defer cancel()
+	m, err := ph.fetchAsync(ctx, matchID)
+	if err != nil {
+		ph.logger.Error("async fetch", zap.Error(err))
+		return
+	}
+	if m.Finished || len(m.Players) == 0 {
+		return
+	}
+	sessions, err := ph.asyncSessions(ctx, matchID)
+	if err != nil {
+		ph.logger.Error("async sessions", zap.Error(err))
+		return
+	}
+	done := make(map[string]bool, len(sessions))
+	for _, s := range sessions {
+		done[s.UserID] = s.finished()
+	}
+	for _, id := range m.Players {
+		if !done[id] {
+			return
+		}
+	}
+	if err := ph.finishAsync(ctx, matchID); err != nil {
+		ph.logger.Error("async finish", zap.Error(err))
+	}
+}
+
+// finishAsync compares results of all players and records them as a match.
+// 複数のreplicaから呼ばれても1回だけ記録するよう、Finishedをtransactionで立ててから集計する.
+func (ph *PracticeHandler) finishAsync(ctx context.Context, matchID string) error {
+	k := datastore.NameKey(asyncMatchKind, matchID, nil)
+	setFinished := func(finished bool) (bool, error) {
+		var changed bool
+		_, err := ph.datastore.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			var m AsyncMatch
+			if err := tx.Get(k, &m); err != nil {
+				return err
+			}
+			if m.Finished == finished {
+				return nil
+			}
+			m.Finished, changed = finished, true
+			_, err := tx.Put(k, &m)
+			return err
+		})
+		return changed, err
+	}
+	claimed, err := setFinished(true)
+	if err != nil || !claimed {
+		return err
+	}
+
+	m, err := ph.fetchAsync(ctx, matchID)
+	if err == nil {
+		err = ph.recordAsync(ctx, m)
+	}
+	if err != nil {
+		// 次の機会にやり直せるように戻す
+		if _, rerr := setFinished(false); rerr != nil {
+			ph.logger.Error("async unfinish", zap.Error(rerr))
+		}
+		return err
+	}
+	ph.logger.Info("async match finished", zap.String("id", matchID))
+	return nil
+}
+
+func (ph *PracticeHandler) recordAsync(ctx context.Context, m *AsyncMatch) error {
+	sessions, err := ph.asyncSessions(ctx, m.ID)
+	if err != nil {
+		return err
+	}
+	res := &MatchResult{
+		MatchID:    m.resultID(),
+		Mode:       resultModeAsync,
+		Host:       m.Host,
+		Visibility: visibilityPrivate,
+		StartedAt:  m.CreatedAt,
+		FinishedAt: time.Now(),
+		Quizzes:    m.Quizzes,
+	}
+	// 途中までしか解かなかったplayerも、回答した分で比べる
+	for _, s := range sessions {
+		res.Participants = append(res.Participants, s.UserID)
+		res.Players = append(res.Players, s.player(s.User))
+	}
+	rankPlayers(res.Players)
+	return recordResult(ctx, ph.store, ph.qh, res, ph.logger)
+}
+
+// sweepAsync finishes matches whose deadline has passed.
+func (ph *PracticeHandler) sweepAsync(ctx context.Context) {
+	ticker := time.NewTicker(asyncSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// index.yamlのFinished, Deadlineを使う. 本体はfinishAsyncで読むのでkeyだけでよい
+		q := datastore.NewQuery(asyncMatchKind).Filter("Finished =", false).Filter("Deadline <=", time.Now()).KeysOnly()
+		keys, err := ph.datastore.GetAll(ctx, q, nil)
+		if err != nil {
+			ph.logger.Error("async sweep", zap.Error(err))
+			continue
+		}
+		for _, k := range keys {
+			if err := ph.finishAsync(ctx, k.Name); err != nil {
+				ph.logger.Error("async finish", zap.String("id", k.Name), zap.Error(err))
+			}
+		}
+	}
+}
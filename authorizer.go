@@ -20,6 +20,7 @@ type Authorizer struct {
 	ts           *handlers.TemplateSet
 	oauth2Config *oauth2.Config
 	jwtService   *services.JWT
+	users        *UserHandler
 }
 
 // ServeHTTP is used to be middleware
@@ -49,8 +50,9 @@ func (a *Authorizer) ServeHTTP(w http.ResponseWriter, r *http.Request, next http
 		panic("only map claims is supported now")
 	}
 
+	// idを含まない古いtokenは再度loginしてもらう
 	name, ok := mapClaims["login"].(string)
-	if !ok || name == "" {
+	if !ok || name == "" || userIDFromClaims(mapClaims) == "" {
 		w.Header().Set("Location", "/login?next="+r.URL.Path)
 		w.WriteHeader(http.StatusFound)
 		return
@@ -130,6 +132,12 @@ func (a *Authorizer) GithubCallback(w http.ResponseWriter, r *http.Request, para
 	}
 	log.Debug("fetch_github_user", zap.Reflect("user", res))
 
+	// userを保存できなくてもloginはできるようにする
+	displayName, _ := res["name"].(string)
+	if err := a.users.Upsert(r.Context(), UserFromMapClaims(res), displayName); err != nil {
+		log.Error("upsert_user", zap.Error(err))
+	}
+
 	// jwtにencode
 	idToken, err := a.jwtService.Sign(jwt.MapClaims(res))
 	if err != nil {
@@ -169,7 +177,9 @@ func (a *Authorizer) fetchUser(accessToken string) (map[string]interface{}, erro
 
 func (a *Authorizer) truncateUnnecessaryFields(src map[string]interface{}) map[string]interface{} {
 	var dst = make(map[string]interface{})
+	dst["id"] = src["id"]
 	dst["login"] = src["login"]
+	dst["name"] = src["name"]
 	dst["avatar_url"] = src["avatar_url"]
 	return dst
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Bus is pub/sub used to share match state between replicas.
+// 単一replicaならmemoryBus, 複数replicaならredisBusを使う.
+type Bus interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	// Subscribe delivers messages until ctx is canceled.
+	Subscribe(ctx context.Context, topic string) (<-chan []byte, error)
+}
+
+// 購読側が詰まっている場合はmessageを捨てる. publishする側をblockさせない.
+const subscriberBufferSize = 256
+
+// memoryBus is in-process Bus.
+type memoryBus struct {
+	mu   sync.RWMutex
+	subs map[string]map[chan []byte]bool
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{subs: make(map[string]map[chan []byte]bool)}
+}
+
+// Publish -
+func (b *memoryBus) Publish(ctx context.Context, topic string, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs[topic] {
+		select {
+		case ch <- payload:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe -
+func (b *memoryBus) Subscribe(ctx context.Context, topic string) (<-chan []byte, error) {
+	ch := make(chan []byte, subscriberBufferSize)
+	b.mu.Lock()
+	if b.subs[topic] == nil {
+		b.subs[topic] = make(map[chan []byte]bool)
+	}
+	b.subs[topic][ch] = true
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs[topic], ch)
+		b.mu.Unlock()
+		close(ch)
+	}()
+	return ch, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, ch <-chan []byte) string {
+	t.Helper()
+	select {
+	case payload, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return string(payload)
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+	return ""
+}
+
+func waitClosed(t *testing.T, ch <-chan []byte) {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("channel not closed")
+		}
+	}
+}
+
+// testBus checks behavior common to Bus implementations.
+func testBus(t *testing.T, bus Bus, subscribed func(n int)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := bus.Subscribe(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := bus.Subscribe(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribed(1)
+
+	if err := bus.Publish(context.Background(), "topic", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, ch); got != "hello" {
+		t.Fatalf("received %q", got)
+	}
+	select {
+	case payload := <-other:
+		t.Fatalf("other topic received %q", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// ctxを閉じたら購読は終わる
+	cancel()
+	waitClosed(t, ch)
+	waitClosed(t, other)
+}
+
+func TestMemoryBus(t *testing.T) {
+	testBus(t, newMemoryBus(), func(int) {})
+}
+
+func TestRedisBus(t *testing.T) {
+	s := newRedisStandIn(t)
+	testBus(t, newRedisBus(newRedisClient(s.addr())), func(n int) {
+		waitSubscribers(t, s, "topic", n)
+	})
+}
+
+func waitSubscribers(t *testing.T, s *redisStandIn, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for s.subscribers(topic) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("subscribers = %d, want %d", s.subscribers(topic), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// redisとの接続が切れたら購読は終わり、購読し直せば再び届く. 切れた購読のgoroutineは残らない.
+func TestRedisBusResubscribe(t *testing.T) {
+	s := newRedisStandIn(t)
+	bus := newRedisBus(newRedisClient(s.addr()))
+	// subscribeStatesと同じく、終わらないctxで購読する
+	ctx := context.Background()
+
+	before := runtime.NumGoroutine()
+	ch, err := bus.Subscribe(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, s, "topic", 1)
+	s.dropConnections()
+	waitClosed(t, ch)
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d, before subscribe %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ch, err = bus.Subscribe(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, s, "topic", 1)
+	// publish用の接続も切れているので、つなぎ直すまで繰り返す
+	for i := 0; i < 2; i++ {
+		if err = bus.Publish(context.Background(), "topic", []byte("again")); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, ch); got != "again" {
+		t.Fatalf("received %q", got)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// 複数replicaで動かす場合、matchはそれを作成したreplica(owner)のmemory上にだけ存在する.
+// 他のreplicaに届いたmatchへのrequestはDirectoryでownerを調べて転送する.
+
+const (
+	// ownerが落ちた場合にこの時間でmatchの所有が切れる
+	ownerTTL             = 30 * time.Second
+	ownerRefreshInterval = 10 * time.Second
+	// 転送されてきたrequestであることを示す. 転送のloopを防ぐ
+	forwardedHeader = "X-Quiz-Forwarded-By"
+)
+
+var (
+	errMatchNotFound  = errors.New("match not found")
+	errJoinCodeTaken  = errors.New("join code already taken")
+	errNotMatchOwner  = errors.New("not match owner")
+	errNoRemoteOwners = errors.New("forwarding is disabled")
+)
+
+// Directory records which replica owns each match and join code.
+type Directory interface {
+	// Register claims match and its join code for owner. join codeが使われていたらerrJoinCodeTaken.
+	Register(ctx context.Context, matchID, code, owner string) error
+	// Claim takes over match whose owner is gone. 他のreplicaが所有していたらerrNotMatchOwner.
+	Claim(ctx context.Context, matchID, code, owner string) error
+	// Refresh extends ownership. 他のreplicaのものになっていたらerrNotMatchOwner.
+	Refresh(ctx context.Context, matchID, code, owner string) error
+	Unregister(ctx context.Context, matchID, code, owner string) error
+	Owner(ctx context.Context, matchID string) (string, error)
+	MatchIDByCode(ctx context.Context, code string) (string, error)
+}
+
+// Cluster -
+type Cluster struct {
+	self      string // 他のreplicaから転送を受けるaddress(host:port)
+	directory Directory
+	bus       Bus
+	logger    *zap.Logger
+}
+
+// forward proxies request to owner replica. websocketのupgradeもそのまま中継される.
+func (c *Cluster) forward(w http.ResponseWriter, r *http.Request, owner string) {
+	if c.self == "" {
+		c.logger.Error("forward", zap.Error(errNoRemoteOwners))
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: owner})
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		c.logger.Error("forward", zap.String("owner", owner), zap.Error(err))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	r.Header.Set(forwardedHeader, c.self)
+	proxy.ServeHTTP(w, r)
+}
+
+func isForwarded(r *http.Request) bool {
+	return r.Header.Get(forwardedHeader) != ""
+}
+
+// memoryDirectory is Directory for single replica.
+type memoryDirectory struct {
+	mu     sync.Mutex
+	owners map[string]string // match id => owner
+	codes  map[string]string // join code => match id
+}
+
+func newMemoryDirectory() *memoryDirectory {
+	return &memoryDirectory{
+		owners: make(map[string]string),
+		codes:  make(map[string]string),
+	}
+}
+
+// Register -
+func (d *memoryDirectory) Register(ctx context.Context, matchID, code, owner string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, used := d.codes[code]; used {
+		return errJoinCodeTaken
+	}
+	d.codes[code] = matchID
+	d.owners[matchID] = owner
+	return nil
+}
+
+// Claim -
+func (d *memoryDirectory) Claim(ctx context.Context, matchID, code, owner string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cur, found := d.owners[matchID]; found && cur != owner {
+		return errNotMatchOwner
+	}
+	if id, used := d.codes[code]; used && id != matchID {
+		return errJoinCodeTaken
+	}
+	d.codes[code] = matchID
+	d.owners[matchID] = owner
+	return nil
+}
+
+// Refresh -
+func (d *memoryDirectory) Refresh(ctx context.Context, matchID, code, owner string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.owners[matchID] != owner {
+		return errNotMatchOwner
+	}
+	return nil
+}
+
+// Unregister -
+func (d *memoryDirectory) Unregister(ctx context.Context, matchID, code, owner string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.owners[matchID] == owner {
+		delete(d.owners, matchID)
+		delete(d.codes, code)
+	}
+	return nil
+}
+
+// Owner -
+func (d *memoryDirectory) Owner(ctx context.Context, matchID string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	owner, found := d.owners[matchID]
+	if !found {
+		return "", errMatchNotFound
+	}
+	return owner, nil
+}
+
+// MatchIDByCode -
+func (d *memoryDirectory) MatchIDByCode(ctx context.Context, code string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id, found := d.codes[code]
+	if !found {
+		return "", errMatchNotFound
+	}
+	return id, nil
+}
+
+// redisDirectory is Directory shared by replicas. keyはttl付きでownerが定期的に延長する.
+type redisDirectory struct {
+	client *redisClient
+}
+
+func newRedisDirectory(client *redisClient) *redisDirectory {
+	return &redisDirectory{client: client}
+}
+
+// valueが自分のものである場合だけ延長/削除する
+const (
+	redisExpireIfOwner = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+	redisDeleteIfOwner = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+	// join codeとownerを同時に確保する. 途中で失敗してownerのいないcodeが残らないようにする
+	// KEYS: owner key, code key. ARGV: owner, match id, ttl
+	redisRegister = `
+if not redis.call("SET", KEYS[2], ARGV[2], "NX", "PX", ARGV[3]) then return 0 end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+return 1`
+	// KEYS: owner key, code key. ARGV: owner, match id, ttl
+	redisClaim = `
+local owner = redis.call("GET", KEYS[1])
+if owner and owner ~= ARGV[1] then return 0 end
+local id = redis.call("GET", KEYS[2])
+if id and id ~= ARGV[2] then return -1 end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+redis.call("SET", KEYS[2], ARGV[2], "PX", ARGV[3])
+return 1`
+)
+
+func ownerKey(matchID string) string { return "quiz:match:" + matchID + ":owner" }
+func codeKey(code string) string     { return "quiz:code:" + code }
+
+func ttlMillis() string {
+	return strconv.FormatInt(int64(ownerTTL/time.Millisecond), 10)
+}
+
+// Register -
+func (d *redisDirectory) Register(ctx context.Context, matchID, code, owner string) error {
+	reply, err := d.client.do(ctx, "EVAL", redisRegister, "2", ownerKey(matchID), codeKey(code), owner, matchID, ttlMillis())
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return errJoinCodeTaken
+	}
+	return nil
+}
+
+// Claim -
+func (d *redisDirectory) Claim(ctx context.Context, matchID, code, owner string) error {
+	reply, err := d.client.do(ctx, "EVAL", redisClaim, "2", ownerKey(matchID), codeKey(code), owner, matchID, ttlMillis())
+	if err != nil {
+		return err
+	}
+	switch n, _ := reply.(int64); n {
+	case 0:
+		return errNotMatchOwner
+	case -1:
+		return errJoinCodeTaken
+	}
+	return nil
+}
+
+// Refresh -
+func (d *redisDirectory) Refresh(ctx context.Context, matchID, code, owner string) error {
+	reply, err := d.client.do(ctx, "EVAL", redisExpireIfOwner, "1", ownerKey(matchID), owner, ttlMillis())
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return errNotMatchOwner
+	}
+	_, err = d.client.do(ctx, "EVAL", redisExpireIfOwner, "1", codeKey(code), matchID, ttlMillis())
+	return err
+}
+
+// Unregister -
+func (d *redisDirectory) Unregister(ctx context.Context, matchID, code, owner string) error {
+	if _, err := d.client.do(ctx, "EVAL", redisDeleteIfOwner, "1", ownerKey(matchID), owner); err != nil {
+		return err
+	}
+	_, err := d.client.do(ctx, "EVAL", redisDeleteIfOwner, "1", codeKey(code), matchID)
+	return err
+}
+
+// Owner -
+func (d *redisDirectory) Owner(ctx context.Context, matchID string) (string, error) {
+	return d.get(ctx, ownerKey(matchID))
+}
+
+// MatchIDByCode -
+func (d *redisDirectory) MatchIDByCode(ctx context.Context, code string) (string, error) {
+	return d.get(ctx, codeKey(code))
+}
+
+func (d *redisDirectory) get(ctx context.Context, key string) (string, error) {
+	reply, err := d.client.do(ctx, "GET", key)
+	if err == errRedisNil {
+		return "", errMatchNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	s, _ := reply.(string)
+	return s, nil
+}
+
+func newCluster(redisAddr, self string, logger *zap.Logger) *Cluster {
+	if redisAddr == "" {
+		return &Cluster{directory: newMemoryDirectory(), bus: newMemoryBus(), logger: logger}
+	}
+	client := newRedisClient(redisAddr)
+	return &Cluster{
+		self:      self,
+		directory: newRedisDirectory(client),
+		bus:       newRedisBus(client),
+		logger:    logger,
+	}
+}
+
+// routeMatch serves h if the match :id lives in this replica, otherwise forwards request to its owner.
+func (mg *MatchGroup) routeMatch(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		id := params.ByName("id")
+		if _, found := mg.lookup(id); !found {
+			mg.forwardToOwner(w, r, id)
+			return
+		}
+		h(w, r, params)
+	}
+}
+
+func (mg *MatchGroup) forwardToOwner(w http.ResponseWriter, r *http.Request, id string) {
+	// 転送先にもmatchがなければdirectoryが古いだけなので、さらに転送はしない
+	if isForwarded(r) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	owner, err := mg.cluster.directory.Owner(r.Context(), id)
+	if err == errMatchNotFound || (err == nil && owner == mg.cluster.self) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		mg.logger.Error("owner", zap.String("match", id), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	mg.cluster.forward(w, r, owner)
+}
+
+// matchIDByCode resolves join code through directory. 見つからなければresponseを書いてfalseを返す.
+func (mg *MatchGroup) matchIDByCode(w http.ResponseWriter, r *http.Request, code string) (string, bool) {
+	id, err := mg.cluster.directory.MatchIDByCode(r.Context(), normalizeJoinCode(code))
+	if err == errMatchNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return "", false
+	}
+	if err != nil {
+		mg.logger.Error("join_code", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", false
+	}
+	return id, true
+}
+
+// matchのstateはspectatorから見えるものを全replicaに配る.
+// ownerでないreplicaでもGET /api/v1/match/:id/stateに答えられるようにするため.
+const (
+	stateTopic        = "quiz.match.state"
+	stateQueueSize    = 256
+	publicStateMaxAge = time.Hour
+	// 購読が切れた場合につなぎ直すまでの間隔
+	resubscribeInterval = 3 * time.Second
+)
+
+type publicState struct {
+	MatchID   string                 `json:"match_id"`
+	Version   uint64                 `json:"version"`
+	State     map[string]interface{} `json:"state"`
+	updatedAt time.Time
+}
+
+// startCluster runs background jobs for cluster until ctx is canceled.
+func (mg *MatchGroup) startCluster(ctx context.Context) {
+	mg.states = make(chan []byte, stateQueueSize)
+	mg.public = make(map[string]*publicState)
+	go mg.publishStates(ctx)
+	go mg.subscribeStates(ctx)
+	go mg.refreshOwnership(ctx)
+}
+
+// publishState queues state for publishing. Match.runをblockさせないため、溢れたら捨てる.
+func (mg *MatchGroup) publishState(payload []byte) {
+	select {
+	case mg.states <- payload:
+	default:
+		mg.logger.Warn("state publish queue is full")
+	}
+}
+
+func (mg *MatchGroup) publishStates(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-mg.states:
+			if err := mg.cluster.bus.Publish(ctx, stateTopic, payload); err != nil {
+				mg.logger.Error("publish state", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (mg *MatchGroup) subscribeStates(ctx context.Context) {
+	for ctx.Err() == nil {
+		ch, err := mg.cluster.bus.Subscribe(ctx, stateTopic)
+		if err != nil {
+			mg.logger.Error("subscribe state", zap.Error(err))
+		} else {
+			for payload := range ch {
+				mg.storeState(payload)
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(resubscribeInterval):
+		}
+	}
+}
+
+func (mg *MatchGroup) storeState(payload []byte) {
+	var s publicState
+	if err := json.Unmarshal(payload, &s); err != nil {
+		mg.logger.Error("decode state", zap.Error(err))
+		return
+	}
+	s.updatedAt = time.Now()
+	mg.publicMu.Lock()
+	defer mg.publicMu.Unlock()
+	// 順序が入れ替わって届いた古いstateは無視する
+	if prev, found := mg.public[s.MatchID]; found && prev.Version >= s.Version {
+		return
+	}
+	mg.public[s.MatchID] = &s
+}
+
+// refreshOwnership extends ownership of local matches, adopts orphaned ones and drops old public states.
+func (mg *MatchGroup) refreshOwnership(ctx context.Context) {
+	// 起動時に前回動いていたmatchを復元する
+	mg.adoptMatches(ctx)
+
+	ticker := time.NewTicker(ownerRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		mg.mu.RLock()
+		matches := make([]*Match, 0, len(mg.m))
+		for _, m := range mg.m {
+			matches = append(matches, m)
+		}
+		mg.mu.RUnlock()
+		for _, m := range matches {
+			err := mg.cluster.directory.Refresh(ctx, m.id, m.code, mg.cluster.self)
+			if err == errNotMatchOwner {
+				// ttlが切れている間に他のreplicaに引き継がれた
+				mg.logger.Warn("lost owner", zap.String("match", m.id))
+				mg.remove(m)
+				continue
+			}
+			if err != nil {
+				mg.logger.Error("refresh owner", zap.String("match", m.id), zap.Error(err))
+			}
+		}
+		mg.adoptMatches(ctx)
+
+		mg.publicMu.Lock()
+		for id, s := range mg.public {
+			if time.Since(s.updatedAt) > publicStateMaxAge {
+				delete(mg.public, id)
+			}
+		}
+		mg.publicMu.Unlock()
+	}
+}
+
+// adoptMatches restores active matches whose owner is gone from storage.
+// ownerのreplicaが落ちてttlが切れると、最初にclaimできたreplicaが引き継ぐ.
+func (mg *MatchGroup) adoptMatches(ctx context.Context) {
+	if mg.store == nil {
+		return
+	}
+	records, err := mg.store.Active(ctx)
+	if err != nil {
+		mg.logger.Error("active matches", zap.Error(err))
+		return
+	}
+	for _, rec := range records {
+		if _, found := mg.lookup(rec.ID); found {
+			continue
+		}
+		owner, err := mg.cluster.directory.Owner(ctx, rec.ID)
+		if err == nil && owner != mg.cluster.self {
+			continue
+		}
+		if err != nil && err != errMatchNotFound {
+			mg.logger.Error("owner", zap.String("match", rec.ID), zap.Error(err))
+			continue
+		}
+		if err := mg.cluster.directory.Claim(ctx, rec.ID, rec.Code, mg.cluster.self); err != nil {
+			if err != errNotMatchOwner {
+				mg.logger.Error("claim", zap.String("match", rec.ID), zap.Error(err))
+			}
+			continue
+		}
+		m, err := restoreMatch(rec, mg.qh, mg.logger)
+		if err != nil {
+			mg.logger.Error("restore", zap.String("match", rec.ID), zap.Error(err))
+			continue
+		}
+		mg.put(m)
+		go m.run()
+		mg.logger.Info("restore", zap.String("match", m.id), zap.Int("quiz", m.currentQuiz))
+	}
+}
+
+// MatchState returns spectator view of match. どのreplicaでも答えられる.
+func (mg *MatchGroup) MatchState(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	mg.publicMu.RLock()
+	s, found := mg.public[params.ByName("id")]
+	mg.publicMu.RUnlock()
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	(&apiResponse{Data: s}).write(w)
+}
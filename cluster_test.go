@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testDirectory checks ownership rules common to Directory implementations.
+func testDirectory(t *testing.T, d Directory) {
+	ctx := context.Background()
+	if err := d.Register(ctx, "m1", "1111", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Register(ctx, "m2", "1111", "b"); err != errJoinCodeTaken {
+		t.Fatalf("register taken code = %v", err)
+	}
+	if owner, err := d.Owner(ctx, "m1"); err != nil || owner != "a" {
+		t.Fatalf("owner = %q, %v", owner, err)
+	}
+	if id, err := d.MatchIDByCode(ctx, "1111"); err != nil || id != "m1" {
+		t.Fatalf("match id = %q, %v", id, err)
+	}
+	if _, err := d.Owner(ctx, "missing"); err != errMatchNotFound {
+		t.Fatalf("owner of missing = %v", err)
+	}
+
+	// ownerがいる間は他のreplicaは引き継げない
+	if err := d.Claim(ctx, "m1", "1111", "b"); err != errNotMatchOwner {
+		t.Fatalf("claim owned = %v", err)
+	}
+	if err := d.Refresh(ctx, "m1", "1111", "b"); err != errNotMatchOwner {
+		t.Fatalf("refresh by other = %v", err)
+	}
+	if err := d.Refresh(ctx, "m1", "1111", "a"); err != nil {
+		t.Fatalf("refresh by owner = %v", err)
+	}
+	if err := d.Claim(ctx, "m3", "1111", "b"); err != errJoinCodeTaken {
+		t.Fatalf("claim with taken code = %v", err)
+	}
+
+	// owner以外のunregisterは無視する
+	if err := d.Unregister(ctx, "m1", "1111", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := d.Owner(ctx, "m1"); owner != "a" {
+		t.Fatalf("owner after unregister by other = %q", owner)
+	}
+	if err := d.Unregister(ctx, "m1", "1111", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Owner(ctx, "m1"); err != errMatchNotFound {
+		t.Fatalf("owner after unregister = %v", err)
+	}
+	if _, err := d.MatchIDByCode(ctx, "1111"); err != errMatchNotFound {
+		t.Fatalf("code after unregister = %v", err)
+	}
+}
+
+func TestMemoryDirectory(t *testing.T) {
+	testDirectory(t, newMemoryDirectory())
+}
+
+func TestRedisDirectory(t *testing.T) {
+	s := newRedisStandIn(t)
+	testDirectory(t, newRedisDirectory(newRedisClient(s.addr())))
+}
+
+// ownerが延長しなくなったらttlで期限切れになり、他のreplicaが引き継げる.
+func TestRedisDirectoryExpiry(t *testing.T) {
+	s := newRedisStandIn(t)
+	d := newRedisDirectory(newRedisClient(s.addr()))
+	ctx := context.Background()
+	if err := d.Register(ctx, "m1", "1111", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 延長していれば期限は伸びる
+	s.advance(ownerTTL / 2)
+	if err := d.Refresh(ctx, "m1", "1111", "a"); err != nil {
+		t.Fatal(err)
+	}
+	s.advance(ownerTTL * 3 / 4)
+	if owner, err := d.Owner(ctx, "m1"); err != nil || owner != "a" {
+		t.Fatalf("owner after refresh = %q, %v", owner, err)
+	}
+
+	s.advance(ownerTTL)
+	if _, err := d.Owner(ctx, "m1"); err != errMatchNotFound {
+		t.Fatalf("owner after ttl = %v", err)
+	}
+	if _, err := d.MatchIDByCode(ctx, "1111"); err != errMatchNotFound {
+		t.Fatalf("code after ttl = %v", err)
+	}
+	if err := d.Refresh(ctx, "m1", "1111", "a"); err != errNotMatchOwner {
+		t.Fatalf("refresh after ttl = %v", err)
+	}
+
+	if err := d.Claim(ctx, "m1", "1111", "b"); err != nil {
+		t.Fatalf("claim expired = %v", err)
+	}
+	if owner, _ := d.Owner(ctx, "m1"); owner != "b" {
+		t.Fatalf("owner after claim = %q", owner)
+	}
+	if id, _ := d.MatchIDByCode(ctx, "1111"); id != "m1" {
+		t.Fatalf("code after claim = %q", id)
+	}
+	if err := d.Refresh(ctx, "m1", "1111", "a"); err != errNotMatchOwner {
+		t.Fatalf("refresh by previous owner = %v", err)
+	}
+	// claimもttl付き
+	s.advance(ownerTTL)
+	if _, err := d.Owner(ctx, "m1"); err != errMatchNotFound {
+		t.Fatalf("owner after claim ttl = %v", err)
+	}
+}
+
+// 終了したmatchはretentionが過ぎるとreplicaからもdirectoryからも消え、join codeを使い回せる.
+func TestFinishedMatchIsReleased(t *testing.T) {
+	mg := &MatchGroup{
+		cluster: &Cluster{directory: newMemoryDirectory(), bus: newMemoryBus(), logger: zap.NewNop()},
+		logger:  zap.NewNop(),
+	}
+	quizzes := []*Quiz{{ID: "q0", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}}}
+	m := buildMatch("m", &MatchConfig{RevealPolicy: revealAfterQuestion}, quizzes, nil, zap.NewNop())
+	m.host = "h"
+	m.retention = 10 * time.Millisecond
+	ctx := context.Background()
+	if err := mg.add(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	go m.run()
+
+	for _, action := range []string{controlStart, controlEnd} {
+		req := &controlRequest{user: &User{ID: "h"}, action: action, result: make(chan error, 1)}
+		m.control <- req
+		if err := <-req.result; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-m.done:
+	case <-time.After(time.Second):
+		t.Fatal("finished match is not stopped")
+	}
+	if _, found := mg.lookup("m"); found {
+		t.Fatal("finished match is still in lookup")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := mg.cluster.directory.Owner(ctx, "m")
+		if err == errMatchNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("owner after release = %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := mg.cluster.directory.MatchIDByCode(ctx, m.code); err != errMatchNotFound {
+		t.Fatalf("code after release = %v", err)
+	}
+}
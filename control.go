@@ -0,0 +1,156 @@
+package main
+
+import "time"
+
+// hostによるmatchの操作. 操作はすべてMatch.runで処理し、eventとして記録する.
+
+// MatchEvent is host operation recorded for audit.
+type MatchEvent struct {
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor"`            // user.ID
+	Target  string    `json:"target,omitempty"` // kick/banの対象のuser.ID
+	QuizIdx int       `json:"quiz_idx"`         // 操作した時点で出題中のquiz
+	At      time.Time `json:"at"`
+}
+
+func (m *Match) newEvent(actor *User, action, target string) *MatchEvent {
+	return &MatchEvent{Action: action, Actor: actor.ID, Target: target, QuizIdx: m.currentQuiz, At: time.Now()}
+}
+
+func (m *Match) checkInitializing() error {
+	if m.status != initializing {
+		return newAPIError(errCodeInvalidState, "match has already started")
+	}
+	return nil
+}
+
+func (m *Match) checkInProgress() error {
+	if m.status != starting {
+		return newAPIError(errCodeInvalidAction, "match is not in progress")
+	}
+	return nil
+}
+
+func (m *Match) paused() bool {
+	return !m.pausedAt.IsZero()
+}
+
+// pause freezes time limit of current quiz. 一時停止中は回答できない.
+func (m *Match) pause() error {
+	if err := m.checkInProgress(); err != nil {
+		return err
+	}
+	if m.paused() {
+		return newAPIError(errCodeInvalidAction, "match is already paused")
+	}
+	m.stopTimer()
+	m.pausedAt = time.Now()
+	return nil
+}
+
+// unpause restarts timer with the time left when paused.
+// 止まっていた分だけ出題時刻をずらすので、回答時間やspeed modeの点数にも含まれない.
+func (m *Match) unpause() error {
+	if !m.paused() {
+		return newAPIError(errCodeInvalidAction, "match is not paused")
+	}
+	m.openedAt = m.openedAt.Add(time.Since(m.pausedAt))
+	m.pausedAt = time.Time{}
+	m.startTimer()
+	return nil
+}
+
+// skip moves to next quiz without scoring current one. 回答はなかったことにする.
+func (m *Match) skip() error {
+	if err := m.checkInProgress(); err != nil {
+		return err
+	}
+	m.clearResults(m.currentQuiz)
+	m.nextQuiz()
+	return nil
+}
+
+// reopen asks current quiz again from the beginning. それまでの回答は取り消す.
+func (m *Match) reopen() error {
+	if err := m.checkInProgress(); err != nil {
+		return err
+	}
+	m.stopTimer()
+	m.clearResults(m.currentQuiz)
+	m.quizeAnswerVisibilities[m.currentQuiz] = false
+	m.pausedAt = time.Time{}
+	m.openedAt = time.Now()
+	m.startTimer()
+	return nil
+}
+
+func (m *Match) clearResults(quizIdx int) {
+	for _, ctx := range m.contexts {
+		ctx.Results[quizIdx] = QuizResult{}
+	}
+}
+
+// end finishes match before all quizzes are asked. 出題していないquizは未回答になる.
+func (m *Match) end() error {
+	if err := m.checkInProgress(); err != nil {
+		return err
+	}
+	m.stopTimer()
+	m.pausedAt = time.Time{}
+	m.finish()
+	return nil
+}
+
+// kick removes player from the match. 観戦はできるが、playerとしては戻れない.
+func (m *Match) kick(host *User, target string) error {
+	if target == host.ID {
+		return newAPIError(errCodeInvalidAction, "host can not remove themselves")
+	}
+	if _, found := m.contexts[target]; !found {
+		return newAPIError(errCodeNotParticipant, "user is not in the match")
+	}
+	m.kicked[target] = true
+	m.remove(target, newAPIError(errCodeKicked, "you were removed from the match"))
+	return nil
+}
+
+// ban removes user and refuses any further connection to the match.
+// まだ参加していないuserもbanできる.
+func (m *Match) ban(host *User, target string) error {
+	if target == "" {
+		return newAPIError(errCodeInvalidAction, "target is required")
+	}
+	if target == host.ID {
+		return newAPIError(errCodeInvalidAction, "host can not ban themselves")
+	}
+	m.admittedMu.Lock()
+	m.banned[target] = true
+	delete(m.admitted, target)
+	m.admittedMu.Unlock()
+	m.remove(target, newAPIError(errCodeBanned, "you were banned from the match"))
+	return nil
+}
+
+// remove deletes player's context and closes every connection of the user.
+func (m *Match) remove(userID string, reason *apiError) {
+	if ctx, found := m.contexts[userID]; found {
+		delete(m.contexts, userID)
+		if ctx.Captain {
+			m.electCaptain(ctx.Team)
+		}
+	}
+	for client := range m.clients {
+		if client.user.ID != userID {
+			continue
+		}
+		// 閉じる前に理由を送る. clientはこれを見て再接続をやめる
+		m.sendTo(client, errorFrame("", reason))
+		m.unregisterClient(client)
+	}
+}
+
+func (m *Match) isBanned(userID string) bool {
+	m.admittedMu.Lock()
+	defer m.admittedMu.Unlock()
+	return m.banned[userID]
+}
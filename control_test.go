@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 開始前と終了後はnextで進められず、操作の記録も残らない.
+func TestControlNextRequiresInProgress(t *testing.T) {
+	quizzes := []*Quiz{{ID: "q0", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}}}
+	m := buildMatch("m", &MatchConfig{RevealPolicy: revealAfterQuestion}, quizzes, nil, zap.NewNop())
+	host := &User{ID: "h", Name: "h"}
+	m.host = host.ID
+
+	if err := m.handleControl(host, controlNext, ""); err == nil {
+		t.Fatal("next before start must fail")
+	}
+	if len(m.events) != 0 {
+		t.Fatalf("events = %d", len(m.events))
+	}
+
+	if err := m.handleControl(host, controlStart, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handleControl(host, controlEnd, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handleControl(host, controlNext, ""); err == nil {
+		t.Fatal("next after end must fail")
+	}
+	if len(m.events) != 2 {
+		t.Fatalf("events = %d", len(m.events))
+	}
+}
+
+// 開始済みのmatchへのstartはerrorにして、起きなかった操作を記録しない.
+func TestControlStartOnlyOnce(t *testing.T) {
+	quizzes := []*Quiz{{ID: "q0", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}}}
+	m := buildMatch("m", &MatchConfig{RevealPolicy: revealAfterQuestion}, quizzes, nil, zap.NewNop())
+	host := &User{ID: "h", Name: "h"}
+	m.host = host.ID
+
+	if err := m.handleControl(host, controlStart, ""); err != nil {
+		t.Fatal(err)
+	}
+	err := m.handleControl(host, controlStart, "")
+	if apiErr, ok := err.(*apiError); !ok || apiErr.Code != errCodeInvalidState {
+		t.Fatalf("second start = %v", err)
+	}
+	if len(m.events) != 1 {
+		t.Fatalf("events = %d", len(m.events))
+	}
+}
+
+func controlledMatch(t *testing.T, cfg *MatchConfig) (m *Match, host, player *User) {
+	t.Helper()
+	quizzes := []*Quiz{
+		{ID: "q0", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}},
+		{ID: "q1", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}},
+	}
+	cfg.RevealPolicy = revealImmediate
+	m = buildMatch("m", cfg, quizzes, nil, zap.NewNop())
+	host, player = &User{ID: "h", Name: "h"}, &User{ID: "p", Name: "p"}
+	m.host = host.ID
+	if _, err := m.join(player, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handleControl(host, controlStart, ""); err != nil {
+		t.Fatal(err)
+	}
+	return m, host, player
+}
+
+// 一時停止していた間は制限時間が進まない.
+func TestControlPauseFreezesTimer(t *testing.T) {
+	m, host, player := controlledMatch(t, &MatchConfig{TimeLimitSec: 60})
+	openedAt, deadline := m.openedAt, m.deadline()
+	if err := m.handleControl(host, controlPause, ""); err != nil {
+		t.Fatal(err)
+	}
+	if m.timer != nil {
+		t.Fatal("paused match must stop timer")
+	}
+	err := m.handleSubmission(player, &submission{QuizIdx: 0, OptionIdx: 0})
+	if apiErr, ok := err.(*apiError); !ok || apiErr.Code != errCodeMatchPaused {
+		t.Fatalf("submission while paused = %v", err)
+	}
+
+	// 10秒止めていたことにする
+	m.pausedAt = m.pausedAt.Add(-10 * time.Second)
+	if err := m.handleControl(host, controlResume, ""); err != nil {
+		t.Fatal(err)
+	}
+	if shift := m.openedAt.Sub(openedAt); shift < 10*time.Second || shift > 11*time.Second {
+		t.Fatalf("openedAt shifted %s", shift)
+	}
+	if extended := m.deadline().Sub(deadline); extended < 10*time.Second {
+		t.Fatalf("deadline extended %s", extended)
+	}
+	if m.timer == nil || m.paused() {
+		t.Fatal("resumed match must restart timer")
+	}
+	if err := m.handleSubmission(player, &submission{QuizIdx: 0, OptionIdx: 0}); err != nil {
+		t.Fatalf("submission after resume = %v", err)
+	}
+}
+
+// skipした問題は回答していても採点しない.
+func TestControlSkipLeavesQuizUnscored(t *testing.T) {
+	m, host, player := controlledMatch(t, &MatchConfig{})
+	if err := m.handleSubmission(player, &submission{QuizIdx: 0, OptionIdx: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handleControl(host, controlSkip, ""); err != nil {
+		t.Fatal(err)
+	}
+	if m.currentQuiz != 1 {
+		t.Fatalf("current quiz = %d", m.currentQuiz)
+	}
+	r := m.contexts[player.ID].Results[0]
+	if r.OptionSubmitted || r.Points != 0 {
+		t.Fatalf("skipped result = %+v", r)
+	}
+	if score := m.contexts[player.ID].Score(); score != 0 {
+		t.Fatalf("score = %d", score)
+	}
+}
+
+// reopenすると回答が取り消され、もう一度回答できる.
+func TestControlReopenClearsSubmissions(t *testing.T) {
+	m, host, player := controlledMatch(t, &MatchConfig{})
+	if err := m.handleSubmission(player, &submission{QuizIdx: 0, OptionIdx: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handleControl(host, controlReopen, ""); err != nil {
+		t.Fatal(err)
+	}
+	if r := m.contexts[player.ID].Results[0]; r.OptionSubmitted {
+		t.Fatalf("reopened result = %+v", r)
+	}
+	if err := m.handleSubmission(player, &submission{QuizIdx: 0, OptionIdx: 0}); err != nil {
+		t.Fatalf("submission after reopen = %v", err)
+	}
+	if r := m.contexts[player.ID].Results[0]; !r.Correct {
+		t.Fatalf("result after reopen = %+v", r)
+	}
+}
+
+// kickやbanされたuserはplayerとして参加し直せない.
+func TestControlKickAndBanRefuseJoin(t *testing.T) {
+	m, host, player := controlledMatch(t, &MatchConfig{})
+	if err := m.handleControl(host, controlKick, player.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := m.contexts[player.ID]; found {
+		t.Fatal("kicked player must be removed")
+	}
+	if _, err := m.join(player, ""); err == nil {
+		t.Fatal("kicked player must not join")
+	}
+	// kickされても観戦はできる
+	if !m.isAdmitted(player) {
+		t.Fatal("kicked player can still spectate")
+	}
+
+	// まだ参加していないuserもbanできる
+	other := &User{ID: "o", Name: "o"}
+	if err := m.handleControl(host, controlBan, other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.join(other, ""); err == nil {
+		t.Fatal("banned user must not join")
+	}
+	if m.admit(other, "") || m.isAdmitted(other) {
+		t.Fatal("banned user must not connect")
+	}
+}
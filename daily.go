@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// daily challenge. 毎日全員に同じquizを出し、1人1回だけ挑戦できる.
+// 回答は練習modeと同じPracticeSessionで行い、/api/v1/practice/:id/answerで回答する.
+
+const (
+	dailyKind       = "DailyChallenge"
+	dailyQuizNum    = 5
+	dailyDateLayout = "2006-01-02"
+)
+
+// 日付は日本時間で切り替える
+var dailyLocation = time.FixedZone("JST", 9*60*60)
+
+func dailyDate(t time.Time) string {
+	return t.In(dailyLocation).Format(dailyDateLayout)
+}
+
+// DailyChallenge is quiz set of a day. 最初に挑戦されたときに決めて保存する.
+type DailyChallenge struct {
+	Date      string    `json:"date" datastore:"-"` // keyのname
+	QuizIDs   []string  `json:"quiz_ids" datastore:",noindex"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// sampleDaily chooses quizzes of the date deterministically.
+// 日付をseedにするので、同じ日に同じquizの集合から選べば必ず同じ結果になる.
+func sampleDaily(date string, ids []string, n int) []string {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	h := fnv.New64a()
+	h.Write([]byte(date))
+	rnd := rand.New(rand.NewSource(int64(h.Sum64())))
+	rnd.Shuffle(len(sorted), func(i, j int) {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	})
+	if len(sorted) < n {
+		n = len(sorted)
+	}
+	return sorted[:n]
+}
+
+// dailyChallenge returns challenge of the date. 今日の分がまだなければ作る.
+func (ph *PracticeHandler) dailyChallenge(ctx context.Context, date string) (*DailyChallenge, error) {
+	k := datastore.NameKey(dailyKind, date, nil)
+	var c DailyChallenge
+	err := ph.datastore.Get(ctx, k, &c)
+	if err == nil {
+		c.Date = date
+		return &c, nil
+	}
+	// 過去の日付は後から作らない. 未来の分は先に見られてしまう
+	if err != datastore.ErrNoSuchEntity || date != dailyDate(time.Now()) {
+		return nil, err
+	}
+
+	keys, err := ph.datastore.GetAll(ctx, datastore.NewQuery(quizKind).KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = k.Encode()
+	}
+	created := &DailyChallenge{Date: date, QuizIDs: sampleDaily(date, ids, dailyQuizNum), CreatedAt: time.Now()}
+	if len(created.QuizIDs) == 0 {
+		return nil, newAPIError(errCodeNotEnoughQuiz, "no quiz to challenge")
+	}
+	// 他のreplicaが先に作っていたらそちらを使う
+	_, err = ph.datastore.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		err := tx.Get(k, &c)
+		if err == nil {
+			created = &c
+			created.Date = date
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = tx.Put(k, created)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// dailyView is challenge of a day as seen by the user.
+type dailyView struct {
+	Date    string        `json:"date"`
+	QuizNum int           `json:"quiz_num"`
+	Attempt *practiceView `json:"attempt"` // まだ挑戦していなければnil
+	// 解き終えたか日付が変わったら正解つきで公開する
+	Quizzes []*QuizView `json:"quizzes,omitempty"`
+	Streak  int         `json:"streak"`
+}
+
+// readDailyDate parses ?date=. 省略時は今日.
+func readDailyDate(r *http.Request) (string, error) {
+	today := dailyDate(time.Now())
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		return today, nil
+	}
+	if _, err := time.ParseInLocation(dailyDateLayout, date, dailyLocation); err != nil || date > today {
+		return "", newAPIError(errCodeInvalidRequest, "date must be YYYY-MM-DD and not in the future")
+	}
+	return date, nil
+}
+
+// GetDaily returns challenge of the date and user's attempt.
+func (ph *PracticeHandler) GetDaily(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	date, err := readDailyDate(r)
+	if err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: err})
+		return
+	}
+	c, err := ph.dailyChallenge(r.Context(), date)
+	if err == datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if apiErr, ok := err.(*apiError); ok {
+		fail(w, http.StatusNotFound, &apiResponse{Err: apiErr})
+		return
+	}
+	if err != nil {
+		ph.logger.Error("daily challenge", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+
+	v := &dailyView{Date: date, QuizNum: len(c.QuizIDs)}
+	s, err := ph.fetch(r.Context(), userSessionID(date, user.ID))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		ph.logger.Error("daily attempt", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	if err == nil {
+		v.Attempt = s.view()
+	}
+	if date != dailyDate(time.Now()) || (s != nil && s.finished()) {
+		quizzes, err := ph.qh.fetchByIDs(r.Context(), c.QuizIDs)
+		if err != nil {
+			ph.logger.Error("daily quizzes", zap.Error(err))
+			fail(w, http.StatusInternalServerError, &apiResponse{})
+			return
+		}
+		for _, quiz := range quizzes {
+			v.Quizzes = append(v.Quizzes, newQuizView(quiz, true))
+		}
+	}
+	if p, err := ph.qh.users.Fetch(r.Context(), user.ID); err == nil {
+		v.Streak = p.DailyStreak
+	}
+	(&apiResponse{Data: v}).write(w)
+}
+
+// StartDaily starts today's attempt. すでに挑戦していればその状態を返す.
+func (ph *PracticeHandler) StartDaily(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	date := dailyDate(time.Now())
+	c, err := ph.dailyChallenge(r.Context(), date)
+	if apiErr, ok := err.(*apiError); ok {
+		fail(w, http.StatusNotFound, &apiResponse{Err: apiErr})
+		return
+	}
+	if err != nil {
+		ph.logger.Error("daily challenge", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	// 挑戦中にquizが削除されても同じ問題を出せるよう、本体をsessionに保存する
+	quizzes, err := ph.qh.fetchByIDs(r.Context(), c.QuizIDs)
+	if err != nil {
+		ph.logger.Error("daily quizzes", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+
+	s := &PracticeSession{
+		ID:        userSessionID(date, user.ID),
+		UserID:    user.ID,
+		StartedAt: time.Now(),
+		Daily:     date,
+		User:      user,
+		Quizzes:   quizzes,
+		Results:   make([]QuizResult, len(quizzes)),
+	}
+	s.show(s.StartedAt)
+	if err := s.encodeDetail(); err != nil {
+		ph.logger.Error("daily encode", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	k := datastore.NameKey(practiceKind, s.ID, nil)
+	_, err = ph.datastore.RunInTransaction(r.Context(), func(tx *datastore.Transaction) error {
+		var existing PracticeSession
+		err := tx.Get(k, &existing)
+		if err == nil {
+			existing.ID = s.ID
+			s = &existing
+			return s.decodeDetail()
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = tx.Put(k, s)
+		return err
+	})
+	if err != nil {
+		ph.logger.Error("daily start", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	(&apiResponse{Data: s.view()}).write(w)
+}
+
+// recordDaily records finished attempt to streak and ranking of the day.
+func (ph *PracticeHandler) recordDaily(ctx context.Context, user *User, date string, res *MatchResult) error {
+	if err := ph.qh.users.RecordDaily(ctx, user, date); err != nil {
+		return err
+	}
+	return ph.qh.users.leaderboard.RecordDaily(ctx, date, res.Players[0], res.FinishedAt)
+}
+
+// DailyLeaderboard returns ranking of the date by points. ?date=&limit=
+func (ph *PracticeHandler) DailyLeaderboard(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	date, err := readDailyDate(r)
+	if err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: err})
+		return
+	}
+	limit := defaultLeaderboardSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxLeaderboardSize {
+			fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeInvalidRequest, "limit must be 1 to 100")})
+			return
+		}
+		limit = n
+	}
+	entries, err := ph.qh.users.leaderboard.Ranking(r.Context(), dailyPeriodKey(date), rankByPoints, limit)
+	if err != nil {
+		ph.logger.Error("daily leaderboard", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	(&apiResponse{Data: entries}).write(w)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+const (
+	matchIDBytes = 16
+	// 読み間違えやすい文字(0/O, 1/I/L)はいれない
+	joinCodeAlphabet    = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	joinCodeLength      = 6
+	maxJoinCodeAttempts = 10
+)
+
+var errJoinCodeExhausted = errors.New("could not allocate unique join code")
+
+// newMatchID returns random, non-sequential match id.
+func newMatchID() (string, error) {
+	return randomHex(matchIDBytes)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newJoinCode returns short human friendly code like "K7QX2M".
+func newJoinCode() (string, error) {
+	b := make([]byte, joinCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// 256はalphabetの長さで割り切れないので多少偏るが、推測されにくさには影響しない程度
+	for i := range b {
+		b[i] = joinCodeAlphabet[int(b[i])%len(joinCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+func normalizeJoinCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// RenderJoin renders form to enter join code (and passcode).
+func (mg *MatchGroup) RenderJoin(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	code := normalizeJoinCode(params.ByName("code"))
+	private := false
+	if code != "" {
+		id, ok := mg.matchIDByCode(w, r, code)
+		if !ok {
+			return
+		}
+		m, found := mg.lookup(id)
+		if !found {
+			mg.forwardToOwner(w, r, id)
+			return
+		}
+		user, found := UserFromReq(r)
+		if !found {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// passcodeが不要ならそのままmatchへ
+		if m.isAdmitted(user) {
+			redirect(w, r, "/match/"+m.id)
+			return
+		}
+		private = true
+	}
+
+	err := mg.ts.ExecuteTemplate(w, "join", struct {
+		Code    string
+		Private bool
+	}{
+		Code:    code,
+		Private: private,
+	})
+	if err != nil {
+		mg.logger.Error("render join", zap.Error(err))
+	}
+}
+
+type joinRequest struct {
+	Code     string `json:"code"`
+	Passcode string `json:"passcode"`
+}
+
+type joinResponse struct {
+	MatchID string `json:"match_id"`
+	URL     string `json:"url"`
+}
+
+// Join resolves join code and admits the user to the match.
+func (mg *MatchGroup) Join(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+
+	var req joinRequest
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: err})
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: err})
+		return
+	}
+
+	id, ok := mg.matchIDByCode(w, r, req.Code)
+	if !ok {
+		return
+	}
+	m, found := mg.lookup(id)
+	if !found {
+		// ownerでも同じbodyを読めるように戻しておく
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		mg.forwardToOwner(w, r, id)
+		return
+	}
+	if !m.admit(user, req.Passcode) {
+		mg.logger.Info("join", zap.String("match", m.id), zap.String("user", user.Name), zap.String("result", "wrong passcode"))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	(&apiResponse{Data: &joinResponse{MatchID: m.id, URL: "/match/" + m.id}}).write(w)
+}
+
+// redirect keeps query(id_token) so that destination is also authorized.
+func redirect(w http.ResponseWriter, r *http.Request, path string) {
+	location := path
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusFound)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ymgyt/appkit/handlers"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+// leaderboardはmatchの結果やquizの作成のたびに期間ごとの集計へ加算しておき、
+// 表示するときはその期間の集計だけを読む.
+
+const (
+	leaderboardKind = "LeaderboardEntry"
+
+	periodAll     = "all"
+	periodMonthly = "monthly"
+	periodWeekly  = "weekly"
+
+	rankByPoints   = "points"
+	rankByAccuracy = "accuracy"
+	rankByQuizzes  = "quizzes"
+
+	defaultLeaderboardSize = 50
+	maxLeaderboardSize     = 100
+	// これより少ない回答数では正解率のrankingに載せない
+	minAnsweredForAccuracy = 20
+)
+
+// LeaderboardEntry is aggregate of a user in a period.
+type LeaderboardEntry struct {
+	Period       string    `json:"period"` // periodKeyの値
+	UserID       string    `json:"user_id"`
+	Name         string    `json:"name" datastore:",noindex"`
+	AvatarURL    string    `json:"avatar_url" datastore:",noindex"`
+	Points       int       `json:"points"`
+	Matches      int       `json:"matches"`
+	Answered     int       `json:"answered"`
+	Correct      int       `json:"correct"`
+	Quizzes      int       `json:"quizzes"`        // 作成したquiz
+	LastScoredAt time.Time `json:"last_scored_at"` // 同点の場合は先に到達したuserを上にする
+	Accuracy     float64   `json:"accuracy"`       // 正解率のrankingで並べるので保存する
+	Rank         int       `json:"rank" datastore:"-"`
+}
+
+// periodKeys returns keys of periods which t belongs to.
+func periodKeys(t time.Time) []string {
+	year, week := t.ISOWeek()
+	return []string{
+		periodAll,
+		fmt.Sprintf("month:%04d-%02d", t.Year(), t.Month()),
+		fmt.Sprintf("week:%04d-W%02d", year, week),
+	}
+}
+
+func periodKey(period string, t time.Time) (string, bool) {
+	keys := periodKeys(t)
+	switch period {
+	case periodAll:
+		return keys[0], true
+	case periodMonthly:
+		return keys[1], true
+	case periodWeekly:
+		return keys[2], true
+	}
+	return "", false
+}
+
+// Leaderboard -
+type Leaderboard struct {
+	ts        *handlers.TemplateSet
+	datastore *datastore.Client
+	logger    *zap.Logger
+}
+
+// RecordMatch adds match result to entries of each player.
+func (lb *Leaderboard) RecordMatch(ctx context.Context, res *MatchResult) error {
+	for _, player := range res.Players {
+		err := lb.update(ctx, player.User, res.FinishedAt, func(e *LeaderboardEntry) {
+			e.Matches++
+			e.Points += player.Score
+			for _, s := range player.Submissions {
+				if !s.Submitted {
+					continue
+				}
+				e.Answered++
+				if s.Correct {
+					e.Correct++
+				}
+			}
+			if player.Score > 0 {
+				e.LastScoredAt = res.FinishedAt
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordQuiz counts quiz authored by user.
+func (lb *Leaderboard) RecordQuiz(ctx context.Context, user *User) error {
+	return lb.update(ctx, user, time.Now(), func(e *LeaderboardEntry) {
+		e.Quizzes++
+	})
+}
+
+// RecordDaily adds result of daily challenge to ranking of the day.
+// 全問同じquizなので、同点の場合は先に解き終えたuserを上にする.
+func (lb *Leaderboard) RecordDaily(ctx context.Context, date string, player *PlayerResult, finishedAt time.Time) error {
+	return lb.updatePeriod(ctx, player.User, dailyPeriodKey(date), func(e *LeaderboardEntry) {
+		e.Matches++
+		e.Points += player.Score
+		for _, s := range player.Submissions {
+			if !s.Submitted {
+				continue
+			}
+			e.Answered++
+			if s.Correct {
+				e.Correct++
+			}
+		}
+		e.LastScoredAt = finishedAt
+	})
+}
+
+func dailyPeriodKey(date string) string {
+	return "daily:" + date
+}
+
+func (lb *Leaderboard) update(ctx context.Context, user *User, t time.Time, f func(e *LeaderboardEntry)) error {
+	for _, period := range periodKeys(t) {
+		if err := lb.updatePeriod(ctx, user, period, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lb *Leaderboard) updatePeriod(ctx context.Context, user *User, period string, f func(e *LeaderboardEntry)) error {
+	k := datastore.NameKey(leaderboardKind, period+"|"+user.ID, nil)
+	_, err := lb.datastore.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var e LeaderboardEntry
+		if err := tx.Get(k, &e); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		e.Period, e.UserID, e.Name, e.AvatarURL = period, user.ID, user.Name, user.AvatarURL
+		f(&e)
+		if e.Answered > 0 {
+			e.Accuracy = float64(e.Correct) / float64(e.Answered)
+		}
+		_, err := tx.Put(k, &e)
+		return err
+	})
+	return err
+}
+
+// Ranking returns top entries of the period.
+// index.yamlのPeriodと各rankingの値の順で読み、上位limit件と最後の同点のentryだけを読む.
+// Accuracyを保存する前のentryは、次に更新されるまで正解率のrankingに載らない.
+func (lb *Leaderboard) Ranking(ctx context.Context, period, by string, limit int) ([]*LeaderboardEntry, error) {
+	value := rankingValue(by)
+	q := datastore.NewQuery(leaderboardKind).Filter("Period =", period)
+	switch by {
+	case rankByAccuracy:
+		q = q.Order("-Accuracy")
+	case rankByQuizzes:
+		q = q.Filter("Quizzes >", 0).Order("-Quizzes")
+	default:
+		q = q.Order("-Points")
+	}
+
+	var ranked []*LeaderboardEntry
+	itr := lb.datastore.Run(ctx, q)
+	for {
+		var e LeaderboardEntry
+		_, err := itr.Next(&e)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if by == rankByAccuracy && e.Answered < minAnsweredForAccuracy {
+			continue
+		}
+		// 同点の中の順序はmemory上で決めるので、limit件目と同じ値のentryまでは読む
+		if len(ranked) >= limit && value(&e) != value(ranked[len(ranked)-1]) {
+			break
+		}
+		ranked = append(ranked, &e)
+	}
+
+	less, equal := rankingOrder(by)
+	sort.SliceStable(ranked, func(i, j int) bool { return less(ranked[i], ranked[j]) })
+	for i, e := range ranked {
+		e.Rank = i + 1
+		if i > 0 && equal(ranked[i-1], e) {
+			e.Rank = ranked[i-1].Rank
+		}
+	}
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, nil
+}
+
+// rankingValue returns value which query orders entries by.
+func rankingValue(by string) func(e *LeaderboardEntry) float64 {
+	switch by {
+	case rankByAccuracy:
+		return func(e *LeaderboardEntry) float64 { return e.Accuracy }
+	case rankByQuizzes:
+		return func(e *LeaderboardEntry) float64 { return float64(e.Quizzes) }
+	default:
+		return func(e *LeaderboardEntry) float64 { return float64(e.Points) }
+	}
+}
+
+// rankingOrder returns sort order and what counts as tie.
+// pointsの同点は正解率、先にその点数に到達した順. accuracyは回答数、点数の順. quizzesは点数.
+// 最後はuser idで順序を決めるが、rankは同じにする.
+func rankingOrder(by string) (less, equal func(a, b *LeaderboardEntry) bool) {
+	switch by {
+	case rankByAccuracy:
+		less = func(a, b *LeaderboardEntry) bool {
+			if a.Accuracy != b.Accuracy {
+				return a.Accuracy > b.Accuracy
+			}
+			if a.Answered != b.Answered {
+				return a.Answered > b.Answered
+			}
+			if a.Points != b.Points {
+				return a.Points > b.Points
+			}
+			return a.UserID < b.UserID
+		}
+		equal = func(a, b *LeaderboardEntry) bool {
+			return a.Accuracy == b.Accuracy && a.Answered == b.Answered && a.Points == b.Points
+		}
+	case rankByQuizzes:
+		less = func(a, b *LeaderboardEntry) bool {
+			if a.Quizzes != b.Quizzes {
+				return a.Quizzes > b.Quizzes
+			}
+			if a.Points != b.Points {
+				return a.Points > b.Points
+			}
+			return a.UserID < b.UserID
+		}
+		equal = func(a, b *LeaderboardEntry) bool {
+			return a.Quizzes == b.Quizzes && a.Points == b.Points
+		}
+	default:
+		less = func(a, b *LeaderboardEntry) bool {
+			if a.Points != b.Points {
+				return a.Points > b.Points
+			}
+			if a.Accuracy != b.Accuracy {
+				return a.Accuracy > b.Accuracy
+			}
+			if !a.LastScoredAt.Equal(b.LastScoredAt) {
+				return a.LastScoredAt.Before(b.LastScoredAt)
+			}
+			return a.UserID < b.UserID
+		}
+		equal = func(a, b *LeaderboardEntry) bool {
+			return a.Points == b.Points && a.Accuracy == b.Accuracy && a.LastScoredAt.Equal(b.LastScoredAt)
+		}
+	}
+	return less, equal
+}
+
+type leaderboardQuery struct {
+	Period    string
+	By        string
+	PeriodKey string
+	Limit     int
+}
+
+// readLeaderboardQuery parses ?period=&by=&limit=. 省略時はall/points.
+func readLeaderboardQuery(r *http.Request) (*leaderboardQuery, error) {
+	q := &leaderboardQuery{Period: periodAll, By: rankByPoints, Limit: defaultLeaderboardSize}
+	values := r.URL.Query()
+	if v := values.Get("period"); v != "" {
+		q.Period = v
+	}
+	key, ok := periodKey(q.Period, time.Now())
+	if !ok {
+		return nil, newAPIError(errCodeInvalidRequest, "unknown period "+q.Period)
+	}
+	q.PeriodKey = key
+	if v := values.Get("by"); v != "" {
+		q.By = v
+	}
+	switch q.By {
+	case rankByPoints, rankByAccuracy, rankByQuizzes:
+	default:
+		return nil, newAPIError(errCodeInvalidRequest, "unknown ranking "+q.By)
+	}
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLeaderboardSize {
+			return nil, newAPIError(errCodeInvalidRequest, "limit must be 1 to 100")
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// Get returns leaderboard.
+func (lb *Leaderboard) Get(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	q, err := readLeaderboardQuery(r)
+	if err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: err})
+		return
+	}
+	entries, err := lb.Ranking(r.Context(), q.PeriodKey, q.By, q.Limit)
+	if err != nil {
+		lb.logger.Error("leaderboard", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	(&apiResponse{Data: entries}).write(w)
+}
+
+// Render -
+func (lb *Leaderboard) Render(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	q, err := readLeaderboardQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	entries, err := lb.Ranking(r.Context(), q.PeriodKey, q.By, q.Limit)
+	if err != nil {
+		lb.logger.Error("leaderboard", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = lb.ts.ExecuteTemplate(w, "leaderboard", struct {
+		Query    *leaderboardQuery
+		Entries  []*LeaderboardEntry
+		Periods  []string
+		Rankings []string
+		IDToken  string
+	}{
+		Query:    q,
+		Entries:  entries,
+		Periods:  []string{periodAll, periodMonthly, periodWeekly},
+		Rankings: []string{rankByPoints, rankByAccuracy, rankByQuizzes},
+		IDToken:  r.URL.Query().Get("id_token"),
+	})
+	if err != nil {
+		lb.logger.Error("render leaderboard", zap.Error(err))
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/gorilla/websocket"
@@ -31,13 +33,21 @@ var (
 	gcpServiceAccountCredential string
 	githubClientID              string
 	githubClientSecret          string
+	publicURL                   string // LBの後ろなどで外から見えるURLが異なる場合に設定する
+	sendPolicy                  *SendPolicy
+	redisAddr                   string // 未設定なら単一replicaとして動く
+	replicaAddr                 string // 他のreplicaからこのreplicaへ届くaddress(host:port)
+	clusterPort                 string // replica間の転送をうけるport
 
 	logger     *zap.Logger
 	hmacSecret = []byte("should_be_more_secret")
 )
 
-func router(ctx context.Context) http.Handler {
+// router returns handler for public port and handler for requests forwarded from other replicas.
+func router(ctx context.Context) (http.Handler, http.Handler) {
 	r := httprouter.New()
+	// 他のreplicaから転送されてくるmatch単位のrequestだけをうける
+	cr := httprouter.New()
 
 	static := handlers.MustStatic(root+"/static", "/static")
 	r.GET("/static/*filepath", static.ServeStatic)
@@ -52,11 +62,16 @@ func router(ctx context.Context) http.Handler {
 		Logger:     logger,
 		HMACSecret: hmacSecret,
 	})
+	// clientはhandlerの間で使い回す
+	ds := datastoreClient(ctx)
+	leaderboard := &Leaderboard{logger: logger, ts: ts, datastore: ds}
+	users := &UserHandler{logger: logger, ts: ts, datastore: ds, leaderboard: leaderboard}
 	authorizer := &Authorizer{
 		ts:           ts,
 		oauth2Config: newOAuth2Config(),
 		logger:       logger,
 		jwtService:   &services.JWT{HMACSecret: hmacSecret},
+		users:        users,
 	}
 	withAuthorize := func(h httprouter.Handle) http.Handler {
 		n := negroni.New(jwtMW, authorizer)
@@ -67,43 +82,81 @@ func router(ctx context.Context) http.Handler {
 	r.GET("/login", authorizer.RenderLogin)
 	r.GET("/oauth/github/callback", authorizer.GithubCallback)
 
-	qh := &QuizHandler{logger: logger, ts: ts, datastore: datastoreClient(ctx)}
+	qh := &QuizHandler{logger: logger, ts: ts, datastore: ds, users: users}
+	qh.reviews = &ReviewQueue{logger: logger, datastore: ds, qh: qh}
 	r.Handler("GET", "/quiz/:id", withAuthorize(qh.RenderQuizForm))
 	r.Handler("POST", "/api/v1/quiz/:id", withAuthorize(qh.Save))
 	r.Handler("GET", "/api/v1/quiz/:id", withAuthorize(qh.Get))
 
+	r.Handler("GET", "/users/:id", withAuthorize(users.RenderProfile))
+	r.Handler("GET", "/api/v1/users/:id", withAuthorize(users.Get))
+	r.Handler("GET", "/leaderboard", withAuthorize(leaderboard.Render))
+	r.Handler("GET", "/api/v1/leaderboard", withAuthorize(leaderboard.Get))
+
 	mg := &MatchGroup{
 		upgrader: websocket.Upgrader{
 			ReadBufferSize: 1024, WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool { return true },
+			CheckOrigin: checkOrigin,
 		},
-		logger: logger,
-		ts:     ts,
-		qh:     qh,
+		logger:     logger,
+		ts:         ts,
+		qh:         qh,
+		sendPolicy: sendPolicy,
+		cluster:    newCluster(redisAddr, replicaAddr, logger),
+		store:      &MatchStore{datastore: ds},
 	}
+	mg.startCluster(ctx)
 	// mg.Init() // 本当はapi callするところ
-	r.Handler("GET", "/match/:id", withAuthorize(mg.RenderMatch))
-	r.POST("/api/v1/match", mg.CreateMatch)
-	r.POST("/api/v1/match/:id/start", mg.StartMatch)
-	r.POST("/api/v1/match/:id/next", mg.NextQuiz)
-	r.Handler("POST", "/api/v1/match/:id/submission", withAuthorize(mg.HandleSubmit))
-
-	// httprouterがhttp.Hijackerを実装していないので、websocketは直接うける
-	go func() {
-		n := negroni.New(jwtMW, authorizer)
-		n.UseHandler(mg)
-		if err := http.ListenAndServe(":9002", n); err != nil {
-			logger.Error("ws", zap.Error(err))
-		}
-	}()
+	// match単位のrequestはmatchをもっているreplicaへ転送する
+	routeMatch := func(method, path string, h httprouter.Handle) {
+		handler := withAuthorize(mg.routeMatch(h))
+		r.Handler(method, path, handler)
+		cr.Handler(method, path, handler)
+	}
+	routeMatch("GET", "/match/:id", mg.RenderMatch)
+	routeMatch("GET", "/match/:id/present", mg.RenderPresenter)
+	r.Handler("GET", "/match/:id/review", withAuthorize(mg.RenderReview))
+	r.Handler("GET", "/join", withAuthorize(mg.RenderJoin))
+	r.Handler("GET", "/join/:code", withAuthorize(mg.RenderJoin))
+	r.Handler("POST", "/api/v1/join", withAuthorize(mg.Join))
+	r.Handler("POST", "/api/v1/match", withAuthorize(mg.CreateMatch))
+	r.Handler("GET", "/api/v1/match/:id/state", withAuthorize(mg.MatchState))
+	r.Handler("GET", "/api/v1/match/:id/results", withAuthorize(mg.MatchResults))
+	r.Handler("GET", "/api/v1/matches", withAuthorize(mg.MatchHistory))
+	routeMatch("POST", "/api/v1/match/:id/start", mg.StartMatch)
+	routeMatch("POST", "/api/v1/match/:id/next", mg.NextQuiz)
+	routeMatch("POST", "/api/v1/match/:id/control", mg.ControlMatch)
+	routeMatch("POST", "/api/v1/match/:id/submission", mg.HandleSubmit)
+
+	practice := &PracticeHandler{logger: logger, datastore: ds, qh: qh, store: mg.store}
+	r.Handler("POST", "/api/v1/practice", withAuthorize(practice.Start))
+	r.Handler("GET", "/api/v1/practice/:id", withAuthorize(practice.Get))
+	r.Handler("POST", "/api/v1/practice/:id/answer", withAuthorize(practice.Answer))
+	r.Handler("GET", "/api/v1/daily", withAuthorize(practice.GetDaily))
+	r.Handler("POST", "/api/v1/daily", withAuthorize(practice.StartDaily))
+	r.Handler("GET", "/api/v1/daily/leaderboard", withAuthorize(practice.DailyLeaderboard))
+	r.Handler("POST", "/api/v1/async", withAuthorize(practice.CreateAsync))
+	r.Handler("GET", "/api/v1/async/:id", withAuthorize(practice.GetAsync))
+	r.Handler("POST", "/api/v1/async/:id/play", withAuthorize(practice.PlayAsync))
+	go practice.sweepAsync(ctx)
+
+	r.Handler("GET", "/api/v1/review/next", withAuthorize(qh.reviews.Next))
+	r.Handler("POST", "/api/v1/review/submission", withAuthorize(qh.reviews.Submit))
+
+	// negroniのResponseWriterはhttp.Hijackerを実装しているので、同じserverでwebsocketもうけられる
+	routeMatch("GET", "/ws/match/:id", mg.ServeWS)
+	routeMatch("GET", "/ws/match/:id/present", mg.ServePresenter)
 
-	common := negroni.New(middlewares.MustLogging(&middlewares.LoggingConfig{
+	loggingMW := middlewares.MustLogging(&middlewares.LoggingConfig{
 		Logger:  logger,
 		Console: true,
-	}))
+	})
+	common := negroni.New(loggingMW)
 	common.UseHandler(r)
+	cluster := negroni.New(loggingMW)
+	cluster.UseHandler(cr)
 
-	return common
+	return common, cluster
 }
 
 func main() {
@@ -117,13 +170,24 @@ func main() {
 	// k8sでの設定に不安があるので、debug
 	spew.Dump("envs", os.Environ())
 
+	h, clusterHandler := router(ctx)
 	s := server.Must(&server.Config{
 		Addr:            ":" + port,
 		DisableHTTPS:    mode == "development",
-		Handler:         router(ctx),
+		Handler:         h,
 		DatastoreClient: datastoreClient(ctx),
 	})
 
+	// 他のreplicaから転送されてくるrequestをうける. cluster内からしか届かないのでhttp
+	if redisAddr != "" {
+		go func() {
+			logger.Info("cluster listening", zap.String("port", clusterPort))
+			if err := http.ListenAndServe(":"+clusterPort, clusterHandler); err != nil {
+				logger.Error("cluster listen", zap.Error(err))
+			}
+		}()
+	}
+
 	fmt.Println("running on ", port)
 	fmt.Println(s.Run())
 }
@@ -158,6 +222,9 @@ func newOAuth2Config() *oauth2.Config {
 }
 
 func endpointBase() string {
+	if publicURL != "" {
+		return strings.TrimRight(publicURL, "/")
+	}
 	scheme := "https"
 	if mode == "development" {
 		scheme = "http"
@@ -165,6 +232,33 @@ func endpointBase() string {
 	return fmt.Sprintf("%s://%s:%s", scheme, host, port)
 }
 
+// wsEndpointBase returns websocket origin. httpsで動いている場合はwss.
+func wsEndpointBase() string {
+	base := endpointBase()
+	if strings.HasPrefix(base, "https://") {
+		return "wss://" + strings.TrimPrefix(base, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(base, "http://")
+}
+
+// checkOrigin allows websocket only from our own pages.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	// browser以外のclient
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if u.Host == r.Host {
+		return true
+	}
+	public, err := url.Parse(endpointBase())
+	return err == nil && u.Host == public.Host
+}
+
 func getUrlParams(router *httprouter.Router, req *http.Request) httprouter.Params {
 	_, params, _ := router.Lookup(req.Method, req.URL.Path)
 	return params
@@ -206,6 +300,16 @@ func checkEnv() {
 	if githubClientSecret == "" {
 		fail("GITHUB_CLIENT_SECRET")
 	}
+	if publicURL != "" {
+		u, err := url.Parse(publicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Println("environment variable APP_PUBLIC_URL must be http(s) url")
+			os.Exit(1)
+		}
+	}
+	if redisAddr != "" && replicaAddr == "" {
+		fail("REPLICA_ADDR")
+	}
 }
 
 func init() {
@@ -217,6 +321,21 @@ func init() {
 	gcpServiceAccountCredential = os.Getenv("GCP_CREDENTIAL")
 	githubClientID = os.Getenv("GITHUB_CLIENT_ID")
 	githubClientSecret = os.Getenv("GITHUB_CLIENT_SECRET")
+	publicURL = os.Getenv("APP_PUBLIC_URL")
+	redisAddr = os.Getenv("REDIS_ADDR")
+	replicaAddr = os.Getenv("REPLICA_ADDR")
+	clusterPort = os.Getenv("CLUSTER_PORT")
+	if clusterPort == "" {
+		clusterPort = "8080"
+	}
 
 	checkEnv()
+
+	// websocketの送信queue. 未設定ならdefault
+	var err error
+	sendPolicy, err = newSendPolicy(os.Getenv("WS_SEND_QUEUE_SIZE"), os.Getenv("WS_SLOW_CONSUMER_POLICY"), os.Getenv("WS_SLOW_CONSUMER_MAX_MISSES"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
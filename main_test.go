@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// package globalのloggerはmainで初期化される
+	logger = zap.NewNop()
+	os.Exit(m.Run())
+}
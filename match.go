@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
-	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
@@ -33,30 +34,59 @@ func (mg *MatchGroup) Init() {
 }
 */
 
+type createMatchResponse struct {
+	MatchID  string `json:"match_id"`
+	JoinCode string `json:"join_code"`
+	JoinURL  string `json:"join_url"`
+}
+
+// CreateMatch creates match from MatchConfig in request body.
 func (mg *MatchGroup) CreateMatch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	if mg.m == nil {
-		mg.m = make(map[string]*Match)
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
 	}
-	mg.counter++
 
-	rawQuizNum := r.URL.Query().Get("quiz")
-	if rawQuizNum == "" {
-		rawQuizNum = "5"
+	cfg, err := readMatchConfig(r)
+	if err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: err})
+		return
 	}
-	quizNum, err := strconv.Atoi(rawQuizNum)
+
+	id, err := newMatchID()
 	if err != nil {
-		quizNum = 5
+		mg.logger.Error("match_id", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
 	}
+	match, err := newMatch(r.Context(), cfg, id, mg.qh, mg.logger)
+	if err != nil {
+		if apiErr, ok := err.(*apiError); ok {
+			fail(w, http.StatusUnprocessableEntity, &apiResponse{Err: apiErr})
+			return
+		}
+		mg.logger.Error("new_match", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	// 作成者はhostとしてpasscodeなしで参加できる
+	match.host = user.ID
+	match.admit(user, cfg.Passcode)
 
-	id := strconv.Itoa(mg.counter)
-	match := newMatch(&MatchConfig{
-		QuizNum: quizNum,
-	}, id, mg.qh, mg.logger)
-	mg.m[id] = match
+	if err := mg.add(r.Context(), match); err != nil {
+		mg.logger.Error("join_code", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
 	go match.run()
 
-	w.Write([]byte(id))
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusCreated)
+	(&apiResponse{Data: &createMatchResponse{
+		MatchID:  match.id,
+		JoinCode: match.code,
+		JoinURL:  endpointBase() + "/join/" + match.code,
+	}}).write(w)
 }
 
 // MatchGroup -
@@ -64,25 +94,130 @@ type MatchGroup struct {
 	ts       *handlers.TemplateSet
 	upgrader websocket.Upgrader
 	logger   *zap.Logger
-	m        map[string]*Match
 	qh       *QuizHandler
-	counter  int // matchのidに利用する
+
+	sendPolicy *SendPolicy // websocketのclientごとのqueue
+	cluster    *Cluster
+	store      *MatchStore
+
+	mu sync.RWMutex
+	m  map[string]*Match // このreplicaがownerのmatch. keyはmatch id
+
+	states   chan []byte // busへpublishするstate
+	publicMu sync.RWMutex
+	public   map[string]*publicState // 全replicaのmatchのstate. keyはmatch id
+}
+
+// add registers match to this replica and assigns a join code to it.
+// join codeはreplica間で重複しないようにdirectoryで確保する.
+func (mg *MatchGroup) add(ctx context.Context, match *Match) error {
+	// 衝突したら引き直す
+	for i := 0; i < maxJoinCodeAttempts; i++ {
+		code, err := newJoinCode()
+		if err != nil {
+			return err
+		}
+		err = mg.cluster.directory.Register(ctx, match.id, code, mg.cluster.self)
+		if err == errJoinCodeTaken {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		match.code = code
+		mg.put(match)
+		return nil
+	}
+	return errJoinCodeExhausted
+}
+
+// put stores match which this replica owns.
+func (mg *MatchGroup) put(match *Match) {
+	if !match.isPrivate() {
+		match.publish = mg.publishState
+	}
+	match.store = mg.store
+	match.release = mg.release
+
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	if mg.m == nil {
+		mg.m = make(map[string]*Match)
+	}
+	mg.m[match.id] = match
+}
+
+// remove stops match which is now owned by other replica or finished.
+// ownerを失ったのと終了したのが重なっても1回だけ止める.
+func (mg *MatchGroup) remove(match *Match) {
+	mg.mu.Lock()
+	current, found := mg.m[match.id]
+	if found && current == match {
+		delete(mg.m, match.id)
+	}
+	mg.mu.Unlock()
+	if found && current == match {
+		close(match.quit)
+	}
+}
+
+// release stops finished match and frees its join code for other matches.
+func (mg *MatchGroup) release(match *Match) {
+	// 先に取り除いておけば、refreshOwnershipが所有を延長し直すことはない
+	mg.remove(match)
+	ctx, cancel := context.WithTimeout(context.Background(), matchSaveTimeout)
+	defer cancel()
+	if err := mg.cluster.directory.Unregister(ctx, match.id, match.code, mg.cluster.self); err != nil {
+		mg.logger.Error("unregister", zap.String("match", match.id), zap.Error(err))
+	}
+}
+
+// lookup returns the match for id if this replica owns it.
+func (mg *MatchGroup) lookup(id string) (*Match, bool) {
+	mg.mu.RLock()
+	defer mg.mu.RUnlock()
+	m, found := mg.m[id]
+	return m, found
 }
 
 // RenderMatch -
-func (mg *MatchGroup) RenderMatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	if err := mg.ts.ExecuteTemplate(w, "match", nil); err != nil {
+func (mg *MatchGroup) RenderMatch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	m, found := mg.lookup(params.ByName("id"))
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	user, found := UserFromReq(r)
+	if !found {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// privateなmatchはpasscodeを入力してもらう
+	if !m.isAdmitted(user) {
+		redirect(w, r, "/join/"+m.code)
+		return
+	}
+
+	err := mg.ts.ExecuteTemplate(w, "match", struct {
+		WSURL string
+	}{
+		WSURL: wsEndpointBase(),
+	})
+	if err != nil {
 		mg.logger.Error("render", zap.Error(err))
 	}
 }
 
-// ServeHTTP for websocket
-func (mg *MatchGroup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ps := strings.Split(r.URL.Path, "/")
-	id := ps[len(ps)-1]
+// ServeWS upgrades connection to websocket and registers it to the match.
+func (mg *MatchGroup) ServeWS(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	mg.serveWS(w, r, params, false)
+}
+
+func (mg *MatchGroup) serveWS(w http.ResponseWriter, r *http.Request, params httprouter.Params, presenter bool) {
+	id := params.ByName("id")
 
 	// matchは事前に作成されている前提
-	m, found := mg.m[id]
+	m, found := mg.lookup(id)
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -94,6 +229,10 @@ func (mg *MatchGroup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	if !m.isAdmitted(user) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 
 	conn, err := mg.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -102,38 +241,72 @@ func (mg *MatchGroup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &Client{
-		user:   user,
-		conn:   conn,
-		send:   make(chan []byte), // bufferにする..?
-		match:  m,
-		logger: mg.logger.With(zap.String("user", user.Name)),
+		user:      user,
+		conn:      conn,
+		out:       newOutbox(mg.sendPolicy),
+		match:     m,
+		logger:    mg.logger.With(zap.String("user", user.Name), zap.Bool("presenter", presenter)),
+		presenter: presenter,
+	}
+	select {
+	case m.register <- client:
+	case <-m.done:
+		// matchは他のreplicaに移った. すぐに閉じて再接続してもらう
+		client.out.close()
 	}
-	client.match.register <- client
 	go client.read()
 	go client.write()
 }
 
 // StartMatch -
 func (mg *MatchGroup) StartMatch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	id := params.ByName("id")
-	m, found := mg.m[id]
-	if !found {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	m.Start()
-	w.WriteHeader(http.StatusOK)
+	mg.handleControl(w, r, params, &hostControlPayload{Action: controlStart})
 }
 
 // NextQuiz -
 func (mg *MatchGroup) NextQuiz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	mg.handleControl(w, r, params, &hostControlPayload{Action: controlNext})
+}
+
+// ControlMatch accepts any host control as {"action": "...", "target": "..."}.
+func (mg *MatchGroup) ControlMatch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	defer r.Body.Close()
+	var p hostControlPayload
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeInvalidRequest, err.Error())})
+		return
+	}
+	mg.handleControl(w, r, params, &p)
+}
+
+func (mg *MatchGroup) handleControl(w http.ResponseWriter, r *http.Request, params httprouter.Params, p *hostControlPayload) {
 	id := params.ByName("id")
-	m, found := mg.m[id]
+	m, found := mg.lookup(id)
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	m.nextQuiz()
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+
+	req := &controlRequest{user: user, action: p.Action, target: p.Target, result: make(chan error, 1)}
+	select {
+	case m.control <- req:
+	case <-m.done:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err := <-req.result; err != nil {
+		status := http.StatusBadRequest
+		if apiErr, ok := err.(*apiError); ok && apiErr.Code == errCodeNotHost {
+			status = http.StatusForbidden
+		}
+		fail(w, status, &apiResponse{Err: err})
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -145,7 +318,7 @@ type submission struct {
 // HandleSubmit is handler for process user quiz submission.
 func (mg *MatchGroup) HandleSubmit(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	id := params.ByName("id")
-	m, found := mg.m[id]
+	m, found := mg.lookup(id)
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -154,41 +327,88 @@ func (mg *MatchGroup) HandleSubmit(w http.ResponseWriter, r *http.Request, param
 	// 誰が接続してきたか確認
 	user, found := UserFromReq(r)
 	if !found {
-		w.WriteHeader(http.StatusUnauthorized)
+		unauthorized(w)
 		return
 	}
 
 	submission, err := mg.readSubmission(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeInvalidRequest, err.Error())})
 		return
 	}
 
-	m.handleSubmission(user, submission)
-	w.WriteHeader(http.StatusOK)
+	req := &submitRequest{user: user, submission: submission, result: make(chan error, 1)}
+	select {
+	case m.submit <- req:
+	case <-m.done:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err := <-req.result; err != nil {
+		fail(w, submissionErrorStatus(err), &apiResponse{Err: err})
+		return
+	}
+	(&apiResponse{Data: submission}).write(w)
 }
 
-func newMatch(cfg *MatchConfig, name string, qh *QuizHandler, logger *zap.Logger) *Match {
-	ctx := context.Background()
-	quizzes, err := qh.PickupFromStorage(ctx, &PickupInput{Max: cfg.QuizNum})
+func submissionErrorStatus(err error) int {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	switch apiErr.Code {
+	case errCodeNotParticipant:
+		return http.StatusForbidden
+	case errCodeQuizClosed, errCodeAlreadySubmitted:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func newMatch(ctx context.Context, cfg *MatchConfig, id string, qh *QuizHandler, logger *zap.Logger) (*Match, error) {
+	quizzes, err := qh.PickupFromStorage(ctx, &PickupInput{
+		Max:          cfg.QuizNum,
+		IDs:          cfg.QuizIDs,
+		Tags:         cfg.Tags,
+		Difficulties: cfg.Difficulties,
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if len(quizzes) == 0 {
+		return nil, newAPIError(errCodeNotEnoughQuiz, "no quiz matched the config")
 	}
-	answerVisibilities := make([]bool, len(quizzes))
+	return buildMatch(id, cfg, quizzes, qh, logger), nil
+}
 
+func buildMatch(id string, cfg *MatchConfig, quizzes []*Quiz, qh *QuizHandler, logger *zap.Logger) *Match {
 	return &Match{
+		id:                      id,
 		qh:                      qh,
-		logger:                  logger.With(zap.String("name", name)),
+		logger:                  logger.With(zap.String("match", id)),
 		register:                make(chan *Client),
 		unregister:              make(chan *Client),
-		answer:                  make(chan []byte),
+		inbound:                 make(chan *inbound),
+		control:                 make(chan *controlRequest),
+		submit:                  make(chan *submitRequest),
+		quit:                    make(chan struct{}),
+		done:                    make(chan struct{}),
 		clients:                 make(map[*Client]bool),
 		contexts:                make(map[string]*Context),
 		status:                  initializing,
 		config:                  cfg,
 		quizzes:                 quizzes,
-		quizeAnswerVisibilities: answerVisibilities,
+		quizeAnswerVisibilities: make([]bool, len(quizzes)),
 		currentQuiz:             -1, // nextQuiz呼んではじめられるように
+		passcode:                cfg.Passcode,
+		admitted:                make(map[string]bool),
+		banned:                  make(map[string]bool),
+		kicked:                  make(map[string]bool),
+		saves:                   make(chan *matchRecord, 1),
+		retention:               finishedMatchRetention,
+		matchmade:               make(chan *matchmakingResult),
+		dirty:                   true, // 最初のtickで保存と配信をする
 	}
 }
 
@@ -201,135 +421,677 @@ func (mg *MatchGroup) readSubmission(r *http.Request) (*submission, error) {
 const (
 	initializing = "initializing"
 	starting     = "starting"
+	finished     = "finished"
 )
 
 // QuizResult -
 type QuizResult struct {
-	OptionSubmitted       bool // userから回答の投稿があったかどうか
-	QuizIdx               int
-	OptionIdx             int
-	Correct               bool
-	UserCanGetTheirResult *bool // quizに正解したかどうかuserにわかるようにしてよいか
+	OptionSubmitted bool // userから回答の投稿があったかどうか
+	QuizIdx         int
+	OptionIdx       int
+	Correct         bool
+	Points          int
+	SubmittedAt     time.Time
+	AnswerTime      time.Duration // 出題からsubmitまで
 }
 
 // Context -
 type Context struct {
+	User    *User
 	Results []QuizResult
+	Ready   bool   // 開始前にplayerが準備完了したか
+	Team    string // team戦でなければ空
+	Captain bool   // 合意modeでteamの回答を決める
+
+	ResumeToken    string    // 再接続時に同じplayerとして戻るためのtoken
+	DisconnectedAt time.Time // 切断中でなければzero
 }
 
-// MatchConfig -
-type MatchConfig struct {
-	QuizNum int
+// Score -
+func (c *Context) Score() int {
+	var score int
+	for _, r := range c.Results {
+		score += r.Points
+	}
+	return score
 }
 
 // Match -
 type Match struct {
-	name   string
+	id     string
+	code   string // 共有用のjoin code
 	qh     *QuizHandler
 	logger *zap.Logger
 
 	// register requests from client
 	register   chan *Client
 	unregister chan *Client
-	answer     chan []byte
+	inbound    chan *inbound // websocketからのmessage
+	control    chan *controlRequest
+	submit     chan *submitRequest
+	// quitを閉じるとrunが終了し、終了したらdoneが閉じられる. 他のreplicaにmatchが移った場合に使う
+	quit chan struct{}
+	done chan struct{}
 
 	clients  map[*Client]bool
-	contexts map[string]*Context // keyはuser.Name
+	contexts map[string]*Context // keyはuser.ID
 	config   *MatchConfig
+	host     string // matchを作成したuser.ID
 
 	status string
 	// quiz関連
 	quizzes                 []*Quiz
 	quizeAnswerVisibilities []bool // 各quizの正解の可視性
 	currentQuiz             int
+	startedAt               time.Time
+	openedAt                time.Time   // currentQuizを出題した時刻
+	timer                   *time.Timer // 制限時間. 設定されていなければnil
+	pausedAt                time.Time   // 一時停止していなければzero
+
+	// privateなmatchはpasscodeを知っているuserだけ参加できる
+	passcode   string
+	admittedMu sync.Mutex
+	admitted   map[string]bool // keyはuser.ID
+	banned     map[string]bool // keyはuser.ID. 接続もできない
+	kicked     map[string]bool // keyはuser.ID. 観戦はできるがplayerには戻れない. Match.runからのみ触る
+
+	events []*MatchEvent // hostの操作
+
+	// clientに送ったstateのversion. 変更があればflushでincrementする
+	version uint64
+	dirty   bool
+	// 他のreplicaへstateを配る. privateなmatchではnil
+	publish func(payload []byte)
+	// snapshotの保存先. nilなら保存しない
+	store       *MatchStore
+	saves       chan *matchRecord
+	unsaved     bool      // 保存していない変更がある
+	savedAt     time.Time // 最後にsaveLoopへ渡した時刻
+	savedStatus string
+
+	// 終了してからretentionが経つとreleaseでreplicaから取り除く. nilなら残しておく
+	retention time.Duration
+	expiry    *time.Timer
+	release   func(m *Match)
+
+	// 開始時にquizを選び直している最中
+	matchmaking bool
+	matchmade   chan *matchmakingResult
+}
+
+func (m *Match) isPrivate() bool {
+	return m.config.Visibility == visibilityPrivate
+}
+
+// admit checks passcode and remembers the user as a participant.
+func (m *Match) admit(user *User, passcode string) bool {
+	if m.isPrivate() && subtle.ConstantTimeCompare([]byte(m.passcode), []byte(passcode)) != 1 {
+		return false
+	}
+	m.admittedMu.Lock()
+	defer m.admittedMu.Unlock()
+	if m.banned[user.ID] {
+		return false
+	}
+	m.admitted[user.ID] = true
+	return true
+}
+
+func (m *Match) isAdmitted(user *User) bool {
+	m.admittedMu.Lock()
+	defer m.admittedMu.Unlock()
+	if m.banned[user.ID] {
+		return false
+	}
+	return !m.isPrivate() || m.admitted[user.ID]
 }
 
 // Start -
 func (m *Match) Start() {
+	if m.status != initializing {
+		return
+	}
 	m.status = starting
+	m.startedAt = time.Now()
 	m.logger.Info("match start")
 	m.nextQuiz()
-	m.updateState()
 }
 
 func (m *Match) run() {
+	ticker := time.NewTicker(broadcastInterval)
+	defer ticker.Stop()
+	if m.store != nil {
+		go m.saveLoop()
+	}
 	for {
+		changed := true
 		select {
+		case <-m.quit:
+			m.stop()
+			return
 		case client := <-m.register:
 			m.registerClient(client)
 		case client := <-m.unregister:
-			if _, ok := m.clients[client]; ok {
-				m.logger.Info("unregister", zap.String("user", client.user.Name))
-				delete(m.clients, client)
-				close(client.send)
-			}
-		case answer := <-m.answer:
-			m.logger.Info("match", zap.String("answer", string(answer)))
-			for client := range m.clients {
-				select {
-				case client.send <- answer:
-				default:
-					// ここはcloseしてしまってよい..?
-					close(client.send)
-					delete(m.clients, client)
-				}
-			}
+			m.unregisterClient(client)
+		case in := <-m.inbound:
+			changed = m.handleInbound(in)
+		case req := <-m.control:
+			req.result <- m.handleControl(req.user, req.action, req.target)
+		case req := <-m.submit:
+			req.result <- m.handleSubmission(req.user, req.submission)
+		case <-m.timeout():
+			m.logger.Info("time up", zap.Int("quiz", m.currentQuiz))
+			m.nextQuiz()
+		case res := <-m.matchmade:
+			m.onMatchmade(res)
+		case <-m.expired():
+			m.logger.Info("match released")
+			m.expiry = nil
+			// releaseはquitを閉じるので、runとは別のgoroutineで呼ぶ
+			go m.release(m)
+		case <-ticker.C:
+			m.flush()
+			changed = false
+		}
+		if changed {
+			m.updateState()
 		}
-		m.updateState()
 	}
 }
 
+// stop disconnects all clients. 再接続したclientはownerになったreplicaへ転送される.
+func (m *Match) stop() {
+	m.logger.Info("match stop")
+	for client := range m.clients {
+		m.unregisterClient(client)
+	}
+	m.stopTimer()
+	if m.expiry != nil {
+		m.expiry.Stop()
+	}
+	close(m.done)
+}
+
 func (m *Match) registerClient(client *Client) {
 	m.logger.Info("register", zap.String("user", client.user.Name))
 	m.clients[client] = true
+	// 接続直後はtickを待たずに全体を送る
+	m.sendSnapshot(client)
+}
 
-	// contextの初期化処理
-	user := client.user
-	ctx, found := m.contexts[user.Name]
-	if !found {
-		ctx = &Context{Results: make([]QuizResult, len(m.quizzes))}
-		m.contexts[user.Name] = ctx
+// join makes user of the client a player. contextの初期化処理.
+func (m *Match) join(user *User, team string) (*Context, error) {
+	if ctx, found := m.contexts[user.ID]; found {
+		if team != "" {
+			if err := m.setTeam(ctx, team); err != nil {
+				return nil, err
+			}
+		}
+		ctx.DisconnectedAt = time.Time{}
+		return ctx, nil
+	}
+	if m.kicked[user.ID] || m.isBanned(user.ID) {
+		return nil, newAPIError(errCodeKicked, "you were removed from the match")
+	}
+	if !m.isTeamMatch() && team != "" {
+		return nil, newAPIError(errCodeInvalidTeam, "match has no teams")
+	}
+	if team != "" && !containsString(m.config.Teams, team) {
+		return nil, newAPIError(errCodeInvalidTeam, "unknown team "+team)
+	}
+	if m.config.MaxPlayers > 0 && len(m.contexts) >= m.config.MaxPlayers {
+		m.logger.Warn("join", zap.String("user", user.Name), zap.String("reason", "match is full"))
+		return nil, newAPIError(errCodeMatchFull, "match is full")
+	}
+	token, err := randomHex(resumeTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &Context{User: user, Results: make([]QuizResult, len(m.quizzes)), ResumeToken: token}
+	m.contexts[user.ID] = ctx
+	if m.isTeamMatch() {
+		// 開始後に参加した場合もteamには入れる
+		if team == "" {
+			team = m.assignTeam()
+		}
+		ctx.Team = team
+		m.electCaptain(team)
+	}
+	m.logger.Info("join", zap.String("user", user.Name), zap.String("team", ctx.Team))
+	return ctx, nil
+}
+
+// resume lets player come back to the match after connection dropped.
+func (m *Match) resume(user *User, token string) (*Context, error) {
+	ctx, found := m.contexts[user.ID]
+	if !found || subtle.ConstantTimeCompare([]byte(ctx.ResumeToken), []byte(token)) != 1 {
+		return nil, newAPIError(errCodeInvalidResumeToken, "session can not be resumed")
+	}
+	ctx.DisconnectedAt = time.Time{}
+	m.logger.Info("resume", zap.String("user", user.Name))
+	return ctx, nil
+}
+
+// unregisterClient removes client. playerのcontextは残し、切断中として扱う.
+func (m *Match) unregisterClient(client *Client) {
+	if _, ok := m.clients[client]; !ok {
+		return
+	}
+	m.logger.Info("unregister", zap.String("user", client.user.Name))
+	delete(m.clients, client)
+	client.out.close()
+
+	ctx, found := m.contexts[client.user.ID]
+	if !found || client.presenter {
+		return
+	}
+	// 別のtabなどでまだ接続している
+	for c := range m.clients {
+		if c.user.ID == client.user.ID && !c.presenter {
+			return
+		}
+	}
+	ctx.DisconnectedAt = time.Now()
+}
+
+// handleInbound processes message from client and replies ack or error.
+// stateに変化があった場合にtrueを返す.
+func (m *Match) handleInbound(in *inbound) bool {
+	client, f := in.client, in.frame
+	var requestID string
+	if f != nil {
+		requestID = f.RequestID
+	}
+	reply := func(err error, payload interface{}) {
+		if err != nil {
+			m.sendTo(client, errorFrame(requestID, err))
+			return
+		}
+		m.sendTo(client, ackFrame(requestID, payload))
+	}
+	if in.err != nil {
+		reply(in.err, nil)
+		return false
+	}
+	// presenterは表示専用. 参加も回答もできない
+	if client.presenter && f.Type != msgHeartbeat && f.Type != msgSync {
+		reply(newAPIError(errCodeReadOnly, "presenter can only watch the match"), nil)
+		return false
+	}
+
+	switch f.Type {
+	case msgHeartbeat:
+		reply(nil, &heartbeatAck{ServerTime: time.Now()})
+		return false
+	case msgSync:
+		reply(nil, nil)
+		m.sendSnapshot(client)
+		return false
+	case msgJoin:
+		var p joinPayload
+		if len(f.Payload) > 0 {
+			if err := f.decodePayload(&p); err != nil {
+				reply(err, nil)
+				return false
+			}
+		}
+		ctx, err := m.join(client.user, p.Team)
+		if err != nil {
+			reply(err, nil)
+			return false
+		}
+		reply(nil, &joinAck{Host: client.user.ID == m.host, ResumeToken: ctx.ResumeToken})
+	case msgResume:
+		var p resumePayload
+		if err := f.decodePayload(&p); err != nil {
+			reply(err, nil)
+			return false
+		}
+		ctx, err := m.resume(client.user, p.Token)
+		if err != nil {
+			reply(err, nil)
+			return false
+		}
+		reply(nil, &joinAck{Host: client.user.ID == m.host, ResumeToken: ctx.ResumeToken})
+		// 切断中に進んだ分をまとめて送り直す
+		m.sendSnapshot(client)
+	case msgSubmit:
+		var p submitPayload
+		if err := f.decodePayload(&p); err != nil {
+			reply(err, nil)
+			return false
+		}
+		reply(m.handleSubmission(client.user, &p), nil)
+	case msgTeam:
+		var p teamPayload
+		if err := f.decodePayload(&p); err != nil {
+			reply(err, nil)
+			return false
+		}
+		ctx, found := m.contexts[client.user.ID]
+		if !found {
+			reply(newAPIError(errCodeNotParticipant, "join the match first"), nil)
+			return false
+		}
+		if err := m.setTeam(ctx, p.Team); err != nil {
+			reply(err, nil)
+			return false
+		}
+		reply(nil, nil)
+	case msgReady:
+		var p readyPayload
+		if err := f.decodePayload(&p); err != nil {
+			reply(err, nil)
+			return false
+		}
+		ctx, found := m.contexts[client.user.ID]
+		if !found {
+			reply(newAPIError(errCodeNotParticipant, "join the match first"), nil)
+			return false
+		}
+		ctx.Ready = p.Ready
+		reply(nil, nil)
+	case msgChat:
+		var p chatPayload
+		if err := f.decodePayload(&p); err != nil {
+			reply(err, nil)
+			return false
+		}
+		text := strings.TrimSpace(p.Text)
+		if text == "" || utf8.RuneCountInString(text) > maxChatLength {
+			reply(newAPIError(errCodeInvalidChat, "chat must be 1 to 200 characters"), nil)
+			return false
+		}
+		reply(nil, nil)
+		m.broadcast(encodeFrame(msgChat, "", &chatBroadcast{User: client.user, Text: text, SentAt: time.Now()}))
+		return false
+	case msgHostControl:
+		var p hostControlPayload
+		if err := f.decodePayload(&p); err != nil {
+			reply(err, nil)
+			return false
+		}
+		reply(m.handleControl(client.user, p.Action, p.Target), nil)
+	default:
+		reply(newAPIError(errCodeUnknownType, "unknown message type "+f.Type), nil)
+		return false
+	}
+	return true
+}
+
+const (
+	controlStart  = "start"
+	controlNext   = "next"
+	controlPause  = "pause"
+	controlResume = "resume"
+	controlSkip   = "skip"   // 採点せずに次のquizへ
+	controlReopen = "reopen" // 出題中のquizをはじめからやり直す
+	controlEnd    = "end"
+	controlKick   = "kick"
+	controlBan    = "ban"
+)
+
+// controlRequest is host operation passed to Match.run.
+type controlRequest struct {
+	user   *User
+	action string
+	target string // kick/banの対象のuser.ID
+	result chan error
+}
+
+func (m *Match) handleControl(user *User, action, target string) error {
+	if user.ID != m.host {
+		return newAPIError(errCodeNotHost, "only host can control the match")
+	}
+	// 操作でmatchが終了した場合も結果に含まれるよう、先に記録しておく
+	event := m.newEvent(user, action, target)
+	m.events = append(m.events, event)
+	if err := m.applyControl(user, action, target); err != nil {
+		m.events = m.events[:len(m.events)-1]
+		return err
+	}
+	m.logger.Info("event", zap.String("action", action), zap.String("actor", user.Name), zap.String("target", target), zap.Int("quiz", event.QuizIdx))
+	return nil
+}
+
+func (m *Match) applyControl(user *User, action, target string) error {
+	switch action {
+	case controlStart:
+		// 開始済みのmatchへのstartは何もしないので、eventに残さずerrorを返す
+		if err := m.checkInitializing(); err != nil {
+			return err
+		}
+		if m.config.Matchmaking {
+			return m.matchmake()
+		}
+		m.Start()
+	case controlNext:
+		// 開始前や終了後に進めると存在しないquizを出してしまう
+		if err := m.checkInProgress(); err != nil {
+			return err
+		}
+		m.nextQuiz()
+	case controlPause:
+		return m.pause()
+	case controlResume:
+		return m.unpause()
+	case controlSkip:
+		return m.skip()
+	case controlReopen:
+		return m.reopen()
+	case controlEnd:
+		return m.end()
+	case controlKick:
+		return m.kick(user, target)
+	case controlBan:
+		return m.ban(user, target)
+	default:
+		return newAPIError(errCodeInvalidAction, "unknown action "+action)
 	}
+	return nil
+}
+
+const matchmakingTimeout = 10 * time.Second
+
+type matchmakingResult struct {
+	quizzes []*Quiz
+	err     error
+}
+
+// matchmake picks quizzes near average rating of joined players, then starts the match.
+// datastoreへの問い合わせでrunをblockさせないよう、結果はmatchmadeで受け取る.
+func (m *Match) matchmake() error {
+	if m.matchmaking {
+		return newAPIError(errCodeInvalidAction, "match is already starting")
+	}
+	m.matchmaking = true
+	userIDs := make([]string, 0, len(m.contexts))
+	for id := range m.contexts {
+		userIDs = append(userIDs, id)
+	}
+	input := &PickupInput{Max: m.config.QuizNum, Tags: m.config.Tags, Difficulties: m.config.Difficulties}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), matchmakingTimeout)
+		defer cancel()
+		res := &matchmakingResult{}
+		input.TargetRating, res.err = m.qh.averageRating(ctx, userIDs)
+		if res.err == nil {
+			res.quizzes, res.err = m.qh.PickupFromStorage(ctx, input)
+		}
+		select {
+		case m.matchmade <- res:
+		case <-m.done:
+		}
+	}()
+	return nil
+}
+
+// onMatchmade replaces quizzes and starts. 選び直せなかった場合は作成時のquizで始める.
+func (m *Match) onMatchmade(res *matchmakingResult) {
+	m.matchmaking = false
+	if res.err != nil || len(res.quizzes) == 0 {
+		m.logger.Error("matchmaking", zap.Error(res.err))
+	} else {
+		m.quizzes = res.quizzes
+		m.quizeAnswerVisibilities = make([]bool, len(res.quizzes))
+		for _, ctx := range m.contexts {
+			ctx.Results = make([]QuizResult, len(res.quizzes))
+		}
+	}
+	m.Start()
 }
 
 func (m *Match) nextQuiz() {
+	if m.status == finished {
+		return
+	}
+	m.stopTimer()
+	m.pausedAt = time.Time{}
 	// 現時点までに出題したquizの答えを発表
-	for i := 0; i <= m.currentQuiz; i++ {
-		m.quizeAnswerVisibilities[i] = true
+	if m.config.RevealPolicy != revealAtEnd {
+		m.reveal(m.currentQuiz)
+	}
+	if m.currentQuiz+1 >= len(m.quizzes) {
+		m.finish()
+		return
 	}
 	m.currentQuiz++
-	if m.currentQuiz >= len(m.quizzes) {
-		m.currentQuiz = len(m.quizzes) - 1
+	m.openedAt = time.Now()
+	m.startTimer()
+}
+
+// finish reveals all answers. 最後の問題は表示したままにしておく.
+func (m *Match) finish() {
+	m.status = finished
+	m.reveal(len(m.quizzes) - 1)
+	m.logger.Info("match finished")
+	m.saveResult()
+	if m.release != nil {
+		m.expiry = time.NewTimer(m.retention)
 	}
-	m.updateState()
 }
 
-func (m *Match) handleSubmission(user *User, submission *submission) {
-	m.logger.Info("submission", zap.String("user", user.Name), zap.Int("quiz", submission.QuizIdx), zap.Int("option", submission.OptionIdx))
-	// 未選択状態でsubmitするとindexが-1なので握りつぶす
-	if submission.OptionIdx == -1 {
-		m.logger.Warn("submission", zap.Int("invalid option index", submission.OptionIdx))
-		return
+// resultRevealed reports whether players may know if their answers to the quiz are correct.
+// snapshotから復元しても変わらないよう、保存せずにmatchの状態から決める.
+func (m *Match) resultRevealed(quizIdx int) bool {
+	return m.config.RevealPolicy == revealImmediate || m.quizeAnswerVisibilities[quizIdx]
+}
+
+// reveal makes answers of quizzes[0:last] visible.
+func (m *Match) reveal(last int) {
+	for i := 0; i <= last; i++ {
+		m.quizeAnswerVisibilities[i] = true
 	}
-	c, found := m.contexts[user.Name]
+}
+
+// finishedMatchRetention is how long finished match stays so that clients can see final state.
+const finishedMatchRetention = 10 * time.Minute
+
+func (m *Match) expired() <-chan time.Time {
+	if m.expiry == nil {
+		return nil
+	}
+	return m.expiry.C
+}
+
+func (m *Match) timeout() <-chan time.Time {
+	if m.timer == nil {
+		return nil
+	}
+	return m.timer.C
+}
+
+// startTimer fires at deadline of current quiz. 過ぎていればすぐに発火する.
+func (m *Match) startTimer() {
+	if deadline := m.deadline(); !deadline.IsZero() {
+		m.timer = time.NewTimer(time.Until(deadline))
+	}
+}
+
+func (m *Match) stopTimer() {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+}
+
+// deadline returns when current quiz closes. zero if no time limit.
+func (m *Match) deadline() time.Time {
+	limit := m.config.timeLimit()
+	if limit == 0 || m.openedAt.IsZero() {
+		return time.Time{}
+	}
+	return m.openedAt.Add(limit)
+}
+
+// submitRequest is submission passed to Match.run. handleSubmissionの結果をresultで返す.
+type submitRequest struct {
+	user       *User
+	submission *submission
+	result     chan error
+}
+
+func (m *Match) handleSubmission(user *User, submission *submission) error {
+	m.logger.Info("submission", zap.String("user", user.Name), zap.Int("quiz", submission.QuizIdx), zap.Int("option", submission.OptionIdx))
+	c, found := m.contexts[user.ID]
 	if !found {
 		m.logger.Warn("submission", zap.String("user not found", user.Name))
-		return
+		return newAPIError(errCodeNotParticipant, "join the match before submitting")
 	}
-
-	if len(c.Results) <= submission.QuizIdx {
+	if m.status != starting {
+		return newAPIError(errCodeQuizClosed, "match is not in progress")
+	}
+	if m.paused() {
+		return newAPIError(errCodeMatchPaused, "match is paused")
+	}
+	if submission.QuizIdx < 0 || len(c.Results) <= submission.QuizIdx {
 		m.logger.Warn("submission", zap.Int("invalid quiz idx", submission.QuizIdx))
-		return
+		return newAPIError(errCodeInvalidQuizIdx, "no such quiz")
 	}
+	// 出題中のquiz以外には回答できない
+	if submission.QuizIdx != m.currentQuiz || m.quizClosed() {
+		return newAPIError(errCodeQuizClosed, "quiz is already closed")
+	}
+	// 未選択状態でsubmitするとindexが-1になる
+	if !m.hasOption(submission.QuizIdx, submission.OptionIdx) {
+		m.logger.Warn("submission", zap.Int("invalid option index", submission.OptionIdx))
+		return newAPIError(errCodeInvalidOption, "choose one of the options")
+	}
+
+	if err := m.checkTeamSubmission(c); err != nil {
+		return err
+	}
+
 	r := c.Results[submission.QuizIdx]
+	if r.OptionSubmitted && m.config.SubmissionPolicy == submissionSingle {
+		return newAPIError(errCodeAlreadySubmitted, "answer is already locked")
+	}
 	r.OptionSubmitted = true
 	r.QuizIdx = submission.QuizIdx
 	r.OptionIdx = submission.OptionIdx
 	r.Correct = m.isCorrect(submission.QuizIdx, submission.OptionIdx)
-	r.UserCanGetTheirResult = &(m.quizeAnswerVisibilities[submission.QuizIdx])
+	r.SubmittedAt = time.Now()
+	r.AnswerTime = r.SubmittedAt.Sub(m.openedAt)
+	r.Points = m.points(r)
 	c.Results[submission.QuizIdx] = r
 
-	m.updateState()
+	return nil
+}
+
+// quizClosed reports whether time limit of current quiz has passed.
+// timerの発火を待たずに締め切る.
+func (m *Match) quizClosed() bool {
+	deadline := m.deadline()
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+func (m *Match) hasOption(quizIdx, optionIdx int) bool {
+	for _, opt := range m.quizzes[quizIdx].Options {
+		if optionIdx == opt.Index {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *Match) isCorrect(quizIdx, optionIdx int) bool {
@@ -342,24 +1104,191 @@ func (m *Match) isCorrect(quizIdx, optionIdx int) bool {
 	return false
 }
 
+const (
+	pointsPerQuiz  = 100
+	minSpeedPoints = 50 // speed modeでも正解なら最低これだけは入る
+)
+
+// points calculates points for result according to scoring mode.
+func (m *Match) points(r QuizResult) int {
+	if !r.Correct {
+		return 0
+	}
+	if m.config.ScoringMode != scoringSpeed || r.QuizIdx != m.currentQuiz {
+		return pointsPerQuiz
+	}
+	limit := m.config.timeLimit()
+	remaining := m.deadline().Sub(r.SubmittedAt)
+	if remaining < 0 {
+		remaining = 0
+	}
+	bonus := int(int64(pointsPerQuiz-minSpeedPoints) * int64(remaining) / int64(limit))
+	return minSpeedPoints + bonus
+}
+
+// broadcastInterval is how often state changes are flushed to clients.
+// 回答やchatが集中しても1tickにつき1回しか送らない.
+const broadcastInterval = 100 * time.Millisecond
+
+// updateState marks state as changed. 実際の送信はflushでまとめて行う.
 func (m *Match) updateState() {
+	m.dirty = true
+}
+
+// flush sends each client a patch from the state it received last.
+// playerは自分の回答しか見えないので個別に作り、host/spectatorはroleごとに共有する.
+func (m *Match) flush() {
+	// queueが溢れてstateを捨てられたclientには全体を送り直す
+	for client := range m.clients {
+		if client.out.takeStale() {
+			m.sendSnapshot(client)
+		}
+	}
+	// 見送った保存は変更がなくても次のtickで行う
+	defer m.persist()
+	if !m.dirty {
+		return
+	}
+	m.dirty = false
+	m.unsaved = true
+	m.version++
+
 	state := m.state()
-	encoded := state.encode()
+	shared := make(map[string]map[string]interface{})
 	for client := range m.clients {
-		fmt.Println("send", client.user.Name)
-		select {
-		case client.send <- encoded:
-		default:
-			m.logger.Warn("send state fail", zap.String("client", client.user.Name))
-			close(client.send)
-			delete(m.clients, client)
+		role := m.clientRole(client)
+		view, found := shared[role]
+		if !found {
+			var err error
+			view, err = toGeneric(state.viewFor(m.viewerOf(client, role), role))
+			if err != nil {
+				m.logger.Error("state", zap.Error(err))
+				continue
+			}
+			if role != viewerPlayer {
+				shared[role] = view
+			}
+		}
+
+		patch := mergePatch(client.lastView, view)
+		if len(patch) == 0 {
+			continue
 		}
+		m.sendStateTo(client, encodeFrame(msgPatch, "", &patchPayload{
+			Base:    client.lastVersion,
+			Version: m.version,
+			Patch:   patch,
+		}))
+		client.lastView, client.lastVersion = view, m.version
+	}
+
+	if m.publish != nil {
+		m.publishState(state)
+	}
+}
+
+// publishState shares spectator view with other replicas.
+func (m *Match) publishState(state *State) {
+	view, err := toGeneric(state.viewFor(&User{}, viewerSpectator))
+	if err != nil {
+		m.logger.Error("state", zap.Error(err))
+		return
+	}
+	payload, err := json.Marshal(&publicState{MatchID: m.id, Version: m.version, State: view})
+	if err != nil {
+		m.logger.Error("state", zap.Error(err))
+		return
+	}
+	m.publish(payload)
+}
+
+// sendSnapshot sends whole state. 接続時とclientから再同期を求められた時に使う.
+func (m *Match) sendSnapshot(client *Client) {
+	role := m.clientRole(client)
+	view, err := toGeneric(m.state().viewFor(m.viewerOf(client, role), role))
+	if err != nil {
+		m.logger.Error("state", zap.Error(err))
+		return
+	}
+	m.sendStateTo(client, encodeFrame(msgState, "", &snapshotPayload{Version: m.version, State: view}))
+	client.lastView, client.lastVersion = view, m.version
+}
+
+const (
+	viewerPlayer    = "player"
+	viewerHost      = "host" // playerとして参加していないhost
+	viewerSpectator = "spectator"
+	viewerPresenter = "presenter" // 大画面に映す表示専用のclient
+)
+
+// clientRole returns role of the connection. presenterはuserに関わらず表示専用.
+func (m *Match) clientRole(client *Client) string {
+	if client.presenter {
+		return viewerPresenter
+	}
+	return m.viewerRole(client.user)
+}
+
+// viewerOf returns whose view the client receives. player以外のroleは誰でも同じviewを共有するので匿名で作る.
+// presenterがplayerとして参加しているuserでも、本人やteamの回答が大画面に映らないようにする.
+func (m *Match) viewerOf(client *Client, role string) *User {
+	if role == viewerPlayer {
+		return client.user
+	}
+	return &User{}
+}
+
+func (m *Match) viewerRole(user *User) string {
+	if _, found := m.contexts[user.ID]; found {
+		return viewerPlayer
+	}
+	if user.ID == m.host {
+		return viewerHost
+	}
+	return viewerSpectator
+}
+
+// isClosed reports whether quiz no longer accepts submissions.
+func (m *Match) isClosed(quizIdx int) bool {
+	if m.status == finished || quizIdx < m.currentQuiz {
+		return true
+	}
+	return quizIdx == m.currentQuiz && m.quizClosed()
+}
+
+func (m *Match) broadcast(message []byte) {
+	for client := range m.clients {
+		m.sendTo(client, message)
+	}
+}
+
+// sendTo queues message to client without blocking. 受け取れないclientは切断する.
+func (m *Match) sendTo(client *Client, message []byte) {
+	m.push(client, message, false)
+}
+
+// sendStateTo queues state or patch message.
+func (m *Match) sendStateTo(client *Client, message []byte) {
+	m.push(client, message, true)
+}
+
+func (m *Match) push(client *Client, message []byte, state bool) {
+	if _, ok := m.clients[client]; !ok {
+		return
+	}
+	if !client.out.push(message, state) {
+		m.logger.Warn("slow consumer", zap.String("client", client.user.Name), zap.String("policy", client.out.policy.OnFull))
+		m.unregisterClient(client)
 	}
 }
 
 func (m *Match) state() *State {
 	var users []*User
 	for c := range m.clients {
+		// presenterは参加者として数えない
+		if c.presenter {
+			continue
+		}
 		users = append(users, c.user)
 	}
 	var quiz *Quiz
@@ -396,23 +1325,26 @@ type Client struct {
 
 	match *Match
 	conn  *websocket.Conn
-	send  chan []byte
-}
+	out   *outbox // Match.runからClient.writeへのmessage
+	// 大画面表示用の接続. Users/Contextsには含めず、回答もさせない
+	presenter bool
 
-type msg struct {
-	Code    int    `json:"code"`
-	ID      int    `json:"id"`
-	Message string `json:"message"`
+	// 最後に送ったstate. patchの計算に使う. Match.runからのみ触る
+	lastView    map[string]interface{}
+	lastVersion uint64
 }
 
 func (c *Client) read() {
 	defer func() {
 		// c.logger.Debug(c.user.Name, zap.String("msg", "read defer"))
-		c.match.unregister <- c
+		select {
+		case c.match.unregister <- c:
+		case <-c.match.done:
+		}
 		c.conn.Close()
 	}()
-	// c.conn.SetReadLimit()
-	c.conn.SetWriteDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
@@ -427,12 +1359,16 @@ func (c *Client) read() {
 		}
 		c.logger.Debug(c.user.Name, zap.String("read_message", string(message)))
 
-		var msg msg
-		if err := json.Unmarshal(message, &msg); err != nil {
-			panic(err)
+		// 不正なframeはerrorを返すだけで接続は維持する
+		f, apiErr := decodeFrame(message)
+		if apiErr != nil {
+			c.logger.Warn("client", zap.String("invalid_frame", apiErr.Error()))
+		}
+		select {
+		case c.match.inbound <- &inbound{client: c, frame: f, err: apiErr}:
+		case <-c.match.done:
+			return
 		}
-
-		c.match.answer <- message
 	}
 }
 
@@ -445,29 +1381,23 @@ func (c *Client) write() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// match closed channel
+		case <-c.out.wake:
+			messages, closed := c.out.drain()
+			for _, message := range messages {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				// c.logger.Debug(c.user.Name, zap.String("write_message", string(message)))
+				if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+					c.logger.Error("client", zap.Error(err))
+					return
+				}
+			}
+			if closed {
+				// matchから外された
 				c.logger.Info("client", zap.String("msg", "close"))
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				c.logger.Error("client", zap.Error(err))
-				return
-			}
-			// c.logger.Debug(c.user.Name, zap.String("write_message", string(message)))
-			w.Write(message)
-
-			// sampleだとここでさらにc.sendからreadして書き込みをおこなっている
-
-			if err := w.Close(); err != nil {
-				c.logger.Error("client", zap.Error(err))
-				return
-			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultQuizNum = 5
+	maxQuizNum     = 50
+	maxTimeLimit   = 10 * 60 // sec
+
+	scoringStandard = "standard" // 正解1問ごとに一定の点数
+	scoringSpeed    = "speed"    // 早く答えるほど点数が高い
+
+	revealAfterQuestion = "after_question" // 次の問題に進んだら前の問題の正解を発表
+	revealImmediate     = "immediate"      // 回答した時点で本人に正誤を知らせる
+	revealAtEnd         = "end_of_match"   // match終了時にまとめて発表
+
+	submissionSingle     = "single"      // 最初の回答で確定
+	submissionUntilClose = "until_close" // 締め切りまで変更できる
+
+	// host(playerとして参加していない場合)とspectatorが締め切り前の回答をどこまで見られるか
+	answerViewStatus  = "status"  // 回答済みかどうかだけ
+	answerViewChoices = "choices" // 選んだ選択肢まで
+
+	visibilityPublic  = "public"
+	visibilityPrivate = "private" // passcodeが必要
+)
+
+// MatchConfig -
+type MatchConfig struct {
+	QuizNum             int      `json:"quiz_num"`
+	QuizIDs             []string `json:"quiz_ids"`       // 指定された場合はこのquizを順に出題する
+	Tags                []string `json:"tags"`           // いずれかのtagを持つquizから選ぶ
+	Difficulties        []string `json:"difficulties"`   // いずれかの難易度のquizから選ぶ
+	Matchmaking         bool     `json:"matchmaking"`    // 開始時に参加者の平均ratingに近いquizを選び直す
+	TimeLimitSec        int      `json:"time_limit_sec"` // 1問あたりの制限時間. 0は無制限
+	ScoringMode         string   `json:"scoring_mode"`
+	RevealPolicy        string   `json:"reveal_policy"`
+	SubmissionPolicy    string   `json:"submission_policy"`
+	MaxPlayers          int      `json:"max_players"` // 0は無制限
+	HostAnswerView      string   `json:"host_answer_view"`
+	SpectatorAnswerView string   `json:"spectator_answer_view"`
+	Visibility          string   `json:"visibility"`
+	Passcode            string   `json:"passcode,omitempty"`
+	TeamMode            string   `json:"team_mode,omitempty"` // 空ならteam戦にしない
+	Teams               []string `json:"teams,omitempty"`     // team名
+	ConsensusPolicy     string   `json:"consensus_policy,omitempty"`
+}
+
+// readMatchConfig decodes config from request body. empty body means default config.
+func readMatchConfig(r *http.Request) (*MatchConfig, error) {
+	defer r.Body.Close()
+	var cfg MatchConfig
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, newAPIError(errCodeInvalidRequest, err.Error())
+	}
+	cfg.setDefaults()
+	return &cfg, cfg.validate()
+}
+
+func (c *MatchConfig) setDefaults() {
+	if c.QuizNum == 0 {
+		c.QuizNum = defaultQuizNum
+		if len(c.QuizIDs) > 0 {
+			c.QuizNum = len(c.QuizIDs)
+		}
+	}
+	if c.ScoringMode == "" {
+		c.ScoringMode = scoringStandard
+	}
+	if c.RevealPolicy == "" {
+		c.RevealPolicy = revealAfterQuestion
+	}
+	if c.SubmissionPolicy == "" {
+		c.SubmissionPolicy = submissionSingle
+	}
+	if c.HostAnswerView == "" {
+		c.HostAnswerView = answerViewChoices
+	}
+	if c.SpectatorAnswerView == "" {
+		c.SpectatorAnswerView = answerViewStatus
+	}
+	if c.Visibility == "" {
+		c.Visibility = visibilityPublic
+	}
+	if c.TeamMode == teamModeConsensus && c.ConsensusPolicy == "" {
+		c.ConsensusPolicy = consensusMajority
+	}
+}
+
+func (c *MatchConfig) validate() error {
+	invalid := func(msg string) error {
+		return newAPIError(errCodeInvalidConfig, msg)
+	}
+
+	if c.QuizNum < 1 || c.QuizNum > maxQuizNum {
+		return invalid("quiz_num must be between 1 and 50")
+	}
+	if len(c.QuizIDs) > 0 && len(c.Tags) > 0 {
+		return invalid("quiz_ids and tags cannot be used together")
+	}
+	if len(c.QuizIDs) > 0 && len(c.Difficulties) > 0 {
+		return invalid("quiz_ids and difficulties cannot be used together")
+	}
+	if len(c.QuizIDs) > 0 && c.Matchmaking {
+		return invalid("quiz_ids and matchmaking cannot be used together")
+	}
+	for _, d := range c.Difficulties {
+		if !isDifficultyLevel(d) {
+			return invalid("unknown difficulty " + d)
+		}
+	}
+	if len(c.QuizIDs) > 0 && c.QuizNum != len(c.QuizIDs) {
+		return invalid("quiz_num must match the number of quiz_ids")
+	}
+	if c.TimeLimitSec < 0 || c.TimeLimitSec > maxTimeLimit {
+		return invalid("time_limit_sec must be between 0 and 600")
+	}
+	switch c.ScoringMode {
+	case scoringStandard:
+	case scoringSpeed:
+		if c.TimeLimitSec == 0 {
+			return invalid("scoring_mode speed requires time_limit_sec")
+		}
+	default:
+		return invalid("unknown scoring_mode " + c.ScoringMode)
+	}
+	switch c.RevealPolicy {
+	case revealAfterQuestion, revealImmediate, revealAtEnd:
+	default:
+		return invalid("unknown reveal_policy " + c.RevealPolicy)
+	}
+	switch c.SubmissionPolicy {
+	case submissionSingle:
+	case submissionUntilClose:
+		// 正誤を見てから回答を変えられてしまう
+		if c.RevealPolicy == revealImmediate {
+			return invalid("reveal_policy immediate requires submission_policy single")
+		}
+	default:
+		return invalid("unknown submission_policy " + c.SubmissionPolicy)
+	}
+	if c.MaxPlayers < 0 {
+		return invalid("max_players must not be negative")
+	}
+	for _, v := range []string{c.HostAnswerView, c.SpectatorAnswerView} {
+		if v != answerViewStatus && v != answerViewChoices {
+			return invalid("unknown answer view " + v)
+		}
+	}
+	switch c.Visibility {
+	case visibilityPublic:
+		if c.Passcode != "" {
+			return invalid("passcode is only for private match")
+		}
+	case visibilityPrivate:
+		if c.Passcode == "" {
+			return invalid("private match requires passcode")
+		}
+	default:
+		return invalid("unknown visibility " + c.Visibility)
+	}
+	return c.validateTeams()
+}
+
+func (c *MatchConfig) timeLimit() time.Duration {
+	return time.Duration(c.TimeLimitSec) * time.Second
+}
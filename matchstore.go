@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"go.uber.org/zap"
+)
+
+// matchの状態はstateが変わるとdatastoreへsnapshotとして保存する. 書き込みは1秒に1回までにまとめる.
+// replicaが落ちても、別のreplica(または再起動したreplica)が読み込んで同じ問題から再開できる.
+
+const (
+	matchKind        = "Match"
+	matchSaveTimeout = 10 * time.Second
+	// datastoreは1entityあたり秒間1回程度の書き込みしか続けられないので、それより頻繁には保存しない
+	matchSaveInterval = time.Second
+)
+
+// MatchStore -
+type MatchStore struct {
+	datastore *datastore.Client
+}
+
+// matchRecord is datastore entity of Match.
+type matchRecord struct {
+	ID        string `datastore:"-"` // keyのname
+	Code      string
+	Active    bool // 終了していないmatch. 起動時の復元対象
+	UpdatedAt time.Time
+	Snapshot  []byte `datastore:",noindex"` // matchSnapshotのjson
+}
+
+// matchSnapshot is everything needed to resume Match.
+type matchSnapshot struct {
+	Config             *MatchConfig        `json:"config"`
+	Host               string              `json:"host"`
+	Status             string              `json:"status"`
+	Quizzes            []*Quiz             `json:"quizzes"` // 途中でquizが編集されても同じ問題を出すため本体ごと保存する
+	AnswerVisibilities []bool              `json:"answer_visibilities"`
+	CurrentQuiz        int                 `json:"current_quiz"`
+	StartedAt          time.Time           `json:"started_at"`
+	OpenedAt           time.Time           `json:"opened_at"`
+	PausedAt           time.Time           `json:"paused_at"`
+	Contexts           map[string]*Context `json:"contexts"`
+	Admitted           []string            `json:"admitted"`
+	Banned             []string            `json:"banned"`
+	Kicked             []string            `json:"kicked"`
+	Events             []*MatchEvent       `json:"events"`
+	Version            uint64              `json:"version"`
+}
+
+// Save -
+func (s *MatchStore) Save(ctx context.Context, rec *matchRecord) error {
+	_, err := s.datastore.Put(ctx, datastore.NameKey(matchKind, rec.ID, nil), rec)
+	return err
+}
+
+// Active returns records of matches which are not finished yet.
+func (s *MatchStore) Active(ctx context.Context) ([]*matchRecord, error) {
+	var records []*matchRecord
+	keys, err := s.datastore.GetAll(ctx, datastore.NewQuery(matchKind).Filter("Active =", true), &records)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		records[i].ID = k.Name
+	}
+	return records, nil
+}
+
+// record takes snapshot of match. Match.runからのみ呼ぶ.
+func (m *Match) record() (*matchRecord, error) {
+	m.admittedMu.Lock()
+	admitted := make([]string, 0, len(m.admitted))
+	for name := range m.admitted {
+		admitted = append(admitted, name)
+	}
+	banned := make([]string, 0, len(m.banned))
+	for name := range m.banned {
+		banned = append(banned, name)
+	}
+	m.admittedMu.Unlock()
+	kicked := make([]string, 0, len(m.kicked))
+	for name := range m.kicked {
+		kicked = append(kicked, name)
+	}
+
+	b, err := json.Marshal(&matchSnapshot{
+		Config:             m.config,
+		Host:               m.host,
+		Status:             m.status,
+		Quizzes:            m.quizzes,
+		AnswerVisibilities: m.quizeAnswerVisibilities,
+		CurrentQuiz:        m.currentQuiz,
+		StartedAt:          m.startedAt,
+		OpenedAt:           m.openedAt,
+		PausedAt:           m.pausedAt,
+		Contexts:           m.contexts,
+		Admitted:           admitted,
+		Banned:             banned,
+		Kicked:             kicked,
+		Events:             m.events,
+		Version:            m.version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &matchRecord{
+		ID:        m.id,
+		Code:      m.code,
+		Active:    m.status != finished,
+		UpdatedAt: time.Now(),
+		Snapshot:  b,
+	}, nil
+}
+
+// persist hands latest snapshot to saveLoop. 保存が遅れている場合は古いsnapshotを捨てる.
+// 前回からmatchSaveIntervalが経つまでは保存を見送るが、終了した時はすぐに保存する.
+func (m *Match) persist() {
+	if m.store == nil || !m.unsaved {
+		return
+	}
+	finishing := m.status == finished && m.savedStatus != finished
+	if !finishing && time.Since(m.savedAt) < matchSaveInterval {
+		return
+	}
+	rec, err := m.record()
+	if err != nil {
+		m.logger.Error("snapshot", zap.Error(err))
+		return
+	}
+	m.unsaved, m.savedAt, m.savedStatus = false, time.Now(), m.status
+	select {
+	case <-m.saves:
+	default:
+	}
+	m.saves <- rec
+}
+
+func (m *Match) saveLoop() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case rec := <-m.saves:
+			ctx, cancel := context.WithTimeout(context.Background(), matchSaveTimeout)
+			if err := m.store.Save(ctx, rec); err != nil {
+				m.logger.Error("save match", zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+// restoreMatch rebuilds match from record. 接続していたclientは切断中として扱い、resumeで戻ってもらう.
+func restoreMatch(rec *matchRecord, qh *QuizHandler, logger *zap.Logger) (*Match, error) {
+	var s matchSnapshot
+	if err := json.Unmarshal(rec.Snapshot, &s); err != nil {
+		return nil, err
+	}
+	m := buildMatch(rec.ID, s.Config, s.Quizzes, qh, logger)
+	m.code = rec.Code
+	m.host = s.Host
+	m.status = s.Status
+	m.quizeAnswerVisibilities = s.AnswerVisibilities
+	m.currentQuiz = s.CurrentQuiz
+	m.startedAt = s.StartedAt
+	m.openedAt = s.OpenedAt
+	m.pausedAt = s.PausedAt
+	m.events = s.Events
+	m.version = s.Version
+	for _, name := range s.Admitted {
+		m.admitted[name] = true
+	}
+	for _, name := range s.Banned {
+		m.banned[name] = true
+	}
+	for _, name := range s.Kicked {
+		m.kicked[name] = true
+	}
+	now := time.Now()
+	for name, ctx := range s.Contexts {
+		if ctx.DisconnectedAt.IsZero() {
+			ctx.DisconnectedAt = now
+		}
+		m.contexts[name] = ctx
+	}
+	// 停止していた間に制限時間を過ぎていればすぐに次の問題へ進む. 一時停止中なら再開を待つ
+	if m.status == starting && !m.paused() {
+		m.startTimer()
+	}
+	return m, nil
+}
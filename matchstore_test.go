@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func restoreQuizzes() []*Quiz {
+	return []*Quiz{
+		{ID: "q0", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}},
+		{ID: "q1", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}},
+	}
+}
+
+// failover後に正解を発表しても、落ちる前の回答が点数に反映されること.
+func TestRestoreThenReveal(t *testing.T) {
+	for _, policy := range []string{revealAfterQuestion, revealAtEnd} {
+		t.Run(policy, func(t *testing.T) {
+			m := buildMatch("m", &MatchConfig{RevealPolicy: policy}, restoreQuizzes(), nil, zap.NewNop())
+			player := &User{ID: "p", Name: "p"}
+			if _, err := m.join(player, ""); err != nil {
+				t.Fatal(err)
+			}
+			m.Start()
+			if err := m.handleSubmission(player, &submission{QuizIdx: 0, OptionIdx: 0}); err != nil {
+				t.Fatal(err)
+			}
+
+			rec, err := m.record()
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored, err := restoreMatch(rec, nil, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if score := restored.state().viewFor(player, viewerPlayer).Players["p"].Score; score != 0 {
+				t.Fatalf("score before reveal = %d", score)
+			}
+
+			restored.nextQuiz()
+			if policy == revealAtEnd {
+				restored.nextQuiz()
+			}
+			p := restored.state().viewFor(player, viewerPlayer).Players["p"]
+			if p.Score != pointsPerQuiz {
+				t.Fatalf("score after reveal = %d", p.Score)
+			}
+			if p.Results[0].Status != resultCorrect {
+				t.Fatalf("status after reveal = %s", p.Results[0].Status)
+			}
+		})
+	}
+}
+
+func TestRestoreImmediateReveal(t *testing.T) {
+	m := buildMatch("m", &MatchConfig{RevealPolicy: revealImmediate}, restoreQuizzes(), nil, zap.NewNop())
+	player := &User{ID: "p", Name: "p"}
+	m.join(player, "")
+	m.Start()
+	m.handleSubmission(player, &submission{QuizIdx: 0, OptionIdx: 1})
+
+	rec, err := m.record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := restoreMatch(rec, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := restored.state().viewFor(player, viewerPlayer).Players["p"].Results[0].Status; status != resultWrong {
+		t.Fatalf("status = %s", status)
+	}
+}
+
+func queuedSaves(m *Match) int {
+	select {
+	case <-m.saves:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// snapshotの保存は1秒に1回までにまとめ、終了した時はすぐに保存する.
+func TestPersistThrottle(t *testing.T) {
+	m := buildMatch("m", &MatchConfig{RevealPolicy: revealAfterQuestion}, restoreQuizzes(), nil, zap.NewNop())
+	m.store = &MatchStore{}
+	m.flush()
+	if n := queuedSaves(m); n != 1 {
+		t.Fatalf("first flush saves %d", n)
+	}
+
+	m.Start()
+	m.updateState()
+	m.flush()
+	if n := queuedSaves(m); n != 0 {
+		t.Fatalf("flush within interval saves %d", n)
+	}
+	// 変更がなくても、間隔が空けば見送った分を保存する
+	m.savedAt = m.savedAt.Add(-matchSaveInterval)
+	m.flush()
+	if n := queuedSaves(m); n != 1 {
+		t.Fatalf("flush after interval saves %d", n)
+	}
+	m.flush()
+	if n := queuedSaves(m); n != 0 {
+		t.Fatalf("flush without changes saves %d", n)
+	}
+
+	// finishは結果も保存するので、状態だけ変える
+	m.status = finished
+	m.updateState()
+	m.flush()
+	if n := queuedSaves(m); n != 1 {
+		t.Fatalf("finish saves %d", n)
+	}
+	rec, _ := m.record()
+	if rec.Active {
+		t.Fatal("finished match must be inactive")
+	}
+}
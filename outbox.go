@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// queueが溢れた(clientの読み込みが追いつかない)ときの振る舞い
+const (
+	slowConsumerDropOldest = "drop_oldest" // 古いmessageから捨てる
+	slowConsumerCoalesce   = "coalesce"    // 溜まっているstateを捨てて最新のstateだけ送り直す
+	slowConsumerDisconnect = "disconnect"  // すぐに切断する
+)
+
+const (
+	defaultSendQueueSize    = 64
+	defaultSlowConsumerMiss = 10
+)
+
+// SendPolicy configures per client outbound queue.
+type SendPolicy struct {
+	QueueSize int
+	OnFull    string
+	MaxMisses int // 連続してqueueが溢れた回数がこれを超えたら切断する. 0は切断しない
+}
+
+// newSendPolicy builds policy from env values. 空文字はdefault.
+func newSendPolicy(queueSize, onFull, maxMisses string) (*SendPolicy, error) {
+	p := &SendPolicy{
+		QueueSize: defaultSendQueueSize,
+		OnFull:    slowConsumerCoalesce,
+		MaxMisses: defaultSlowConsumerMiss,
+	}
+	if queueSize != "" {
+		n, err := strconv.Atoi(queueSize)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid send queue size %q", queueSize)
+		}
+		p.QueueSize = n
+	}
+	if onFull != "" {
+		switch onFull {
+		case slowConsumerDropOldest, slowConsumerCoalesce, slowConsumerDisconnect:
+			p.OnFull = onFull
+		default:
+			return nil, fmt.Errorf("unknown slow consumer policy %q", onFull)
+		}
+	}
+	if maxMisses != "" {
+		n, err := strconv.Atoi(maxMisses)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid max misses %q", maxMisses)
+		}
+		p.MaxMisses = n
+	}
+	return p, nil
+}
+
+type outMessage struct {
+	data  []byte
+	state bool // state/patch. 捨てた場合はsnapshotを送り直す必要がある
+}
+
+// outbox is bounded queue between Match.run and Client.write.
+// Match.runはblockせずにpushし、Client.writeがwakeを待ってdrainする.
+// closeは何度呼んでもよい.
+type outbox struct {
+	policy *SendPolicy
+	wake   chan struct{}
+
+	mu     sync.Mutex
+	queue  []outMessage
+	closed bool
+	misses int
+	stale  bool // stateを捨てたのでclientのstateが古いままになっている
+}
+
+func newOutbox(policy *SendPolicy) *outbox {
+	return &outbox{
+		policy: policy,
+		wake:   make(chan struct{}, 1),
+		queue:  make([]outMessage, 0, policy.QueueSize),
+	}
+}
+
+// push enqueues message. clientを切断すべき場合はfalseを返す.
+func (o *outbox) push(data []byte, state bool) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return false
+	}
+
+	if len(o.queue) < o.policy.QueueSize {
+		o.misses = 0
+	} else {
+		o.misses++
+		if o.policy.MaxMisses > 0 && o.misses > o.policy.MaxMisses {
+			return false
+		}
+		switch o.policy.OnFull {
+		case slowConsumerDisconnect:
+			return false
+		case slowConsumerCoalesce:
+			o.dropStates()
+			// 捨てたstateに対するpatchは意味がないので、次のflushでsnapshotを送る
+			if state {
+				// queueにstateがなかった場合も、このstateを捨てたのでsnapshotが必要
+				o.stale = true
+				o.signal()
+				return true
+			}
+			if len(o.queue) >= o.policy.QueueSize {
+				o.dropOldest()
+			}
+		default:
+			o.dropOldest()
+		}
+	}
+
+	o.queue = append(o.queue, outMessage{data: data, state: state})
+	o.signal()
+	return true
+}
+
+func (o *outbox) dropOldest() {
+	if o.queue[0].state {
+		o.stale = true
+	}
+	o.queue = o.queue[1:]
+}
+
+func (o *outbox) dropStates() {
+	kept := o.queue[:0]
+	for _, m := range o.queue {
+		if m.state {
+			o.stale = true
+			continue
+		}
+		kept = append(kept, m)
+	}
+	o.queue = kept
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drain returns queued messages. closedがtrueなら残りを送ったあと接続を閉じる.
+func (o *outbox) drain() (messages [][]byte, closed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, m := range o.queue {
+		messages = append(messages, m.data)
+	}
+	o.queue = o.queue[:0]
+	return messages, o.closed
+}
+
+// takeStale reports whether client needs snapshot, and resets the flag.
+func (o *outbox) takeStale() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stale := o.stale
+	o.stale = false
+	return stale
+}
+
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.signal()
+}
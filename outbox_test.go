@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func testPolicy(onFull string, size, misses int) *SendPolicy {
+	return &SendPolicy{QueueSize: size, OnFull: onFull, MaxMisses: misses}
+}
+
+func drained(o *outbox) []string {
+	messages, _ := o.drain()
+	var s []string
+	for _, m := range messages {
+		s = append(s, string(m))
+	}
+	return s
+}
+
+func TestOutboxDropOldest(t *testing.T) {
+	o := newOutbox(testPolicy(slowConsumerDropOldest, 2, 0))
+	o.push([]byte("s1"), true)
+	o.push([]byte("c1"), false)
+	if !o.push([]byte("c2"), false) {
+		t.Fatal("drop_oldest must not disconnect")
+	}
+	if got := fmt.Sprint(drained(o)); got != "[c1 c2]" {
+		t.Fatalf("queue = %s", got)
+	}
+	// 捨てたのはstateなのでsnapshotを送り直す
+	if !o.takeStale() {
+		t.Fatal("dropped state must mark outbox stale")
+	}
+	if o.takeStale() {
+		t.Fatal("takeStale must reset the flag")
+	}
+}
+
+func TestOutboxCoalesce(t *testing.T) {
+	o := newOutbox(testPolicy(slowConsumerCoalesce, 3, 0))
+	o.push([]byte("s1"), true)
+	o.push([]byte("c1"), false)
+	o.push([]byte("s2"), true)
+	// 溢れたらstateを捨てて、最新のstateは次のflushでsnapshotとして送る
+	if !o.push([]byte("s3"), true) {
+		t.Fatal("coalesce must not disconnect")
+	}
+	if got := fmt.Sprint(drained(o)); got != "[c1]" {
+		t.Fatalf("queue = %s", got)
+	}
+	if !o.takeStale() {
+		t.Fatal("coalesced states must mark outbox stale")
+	}
+
+	// stateがなければ古いmessageから捨てる
+	o = newOutbox(testPolicy(slowConsumerCoalesce, 2, 0))
+	o.push([]byte("c1"), false)
+	o.push([]byte("c2"), false)
+	o.push([]byte("c3"), false)
+	if got := fmt.Sprint(drained(o)); got != "[c2 c3]" {
+		t.Fatalf("queue = %s", got)
+	}
+	// chatなどで埋まっていても、捨てたstateはsnapshotで送り直す
+	o = newOutbox(testPolicy(slowConsumerCoalesce, 2, 0))
+	o.push([]byte("c1"), false)
+	o.push([]byte("c2"), false)
+	o.push([]byte("s1"), true)
+	if got := fmt.Sprint(drained(o)); got != "[c1 c2]" {
+		t.Fatalf("queue = %s", got)
+	}
+	if !o.takeStale() {
+		t.Fatal("dropped state must mark outbox stale")
+	}
+}
+
+func TestOutboxDisconnect(t *testing.T) {
+	o := newOutbox(testPolicy(slowConsumerDisconnect, 1, 0))
+	if !o.push([]byte("c1"), false) {
+		t.Fatal("push within capacity must succeed")
+	}
+	if o.push([]byte("c2"), false) {
+		t.Fatal("disconnect policy must fail when full")
+	}
+}
+
+func TestOutboxMaxMisses(t *testing.T) {
+	o := newOutbox(testPolicy(slowConsumerDropOldest, 1, 2))
+	o.push([]byte("c0"), false)
+	for i := 1; i <= 2; i++ {
+		if !o.push([]byte(fmt.Sprint("c", i)), false) {
+			t.Fatalf("miss %d must be tolerated", i)
+		}
+	}
+	if o.push([]byte("c3"), false) {
+		t.Fatal("must disconnect after MaxMisses")
+	}
+
+	// 読み出して空きができれば数え直す
+	o = newOutbox(testPolicy(slowConsumerDropOldest, 1, 1))
+	o.push([]byte("c0"), false)
+	o.push([]byte("c1"), false)
+	o.drain()
+	o.push([]byte("c2"), false)
+	if !o.push([]byte("c3"), false) {
+		t.Fatal("misses must reset after queue drained")
+	}
+}
+
+func TestOutboxClosed(t *testing.T) {
+	o := newOutbox(testPolicy(slowConsumerCoalesce, 4, 0))
+	o.push([]byte("c1"), false)
+	o.close()
+	o.close()
+	if o.push([]byte("c2"), false) {
+		t.Fatal("push after close must fail")
+	}
+	// 閉じる前に積んだ分は送ってから切断する
+	messages, closed := o.drain()
+	if len(messages) != 1 || !closed {
+		t.Fatalf("drain = %d messages, closed %v", len(messages), closed)
+	}
+}
+
+// go test -raceで、送信とclose/drainが同時に起きても安全なことを確かめる.
+func TestOutboxConcurrentClose(t *testing.T) {
+	o := newOutbox(testPolicy(slowConsumerCoalesce, 8, 0))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				o.push([]byte(fmt.Sprint(i, j)), j%2 == 0)
+			}
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Millisecond)
+			o.close()
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		// Client.writeと同じくwakeを待ってdrainする
+		for {
+			<-o.wake
+			if _, closed := o.drain(); closed {
+				close(done)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer did not observe close")
+	}
+}
+
+// 同じclientに対してread側のunregisterと送信失敗によるunregisterが重なっても、
+// queueを二重に閉じたりpanicしたりしない.
+func TestMatchConcurrentUnregister(t *testing.T) {
+	m := buildMatch("m", &MatchConfig{}, []*Quiz{{ID: "q"}}, nil, zap.NewNop())
+	go m.run()
+	defer close(m.quit)
+
+	// すぐに溢れて切断されるclient
+	client := &Client{
+		user:   &User{ID: "u", Name: "u"},
+		out:    newOutbox(testPolicy(slowConsumerDisconnect, 1, 0)),
+		match:  m,
+		logger: zap.NewNop(),
+	}
+	m.register <- client
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				in := &inbound{client: client, frame: &frame{V: protocolVersion, Type: msgHeartbeat}}
+				select {
+				case m.inbound <- in:
+				case <-m.done:
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case m.unregister <- client:
+			case <-m.done:
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, closed := client.out.drain(); !closed {
+		t.Fatal("client must be closed")
+	}
+}
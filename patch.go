@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// stateをまるごと送らずに、前回clientに送ったstateとの差分(JSON Merge Patch, RFC 7386)を送る.
+// mapは再帰的に比較し、それ以外(配列を含む)は値が変わったらまるごと置き換える.
+// 消えたkeyはnullで表す.
+
+// snapshotPayload is payload of state message.
+type snapshotPayload struct {
+	Version uint64                 `json:"version"`
+	State   map[string]interface{} `json:"state"`
+}
+
+// patchPayload is payload of patch message. clientはbaseのstateにpatchをあててversionにする.
+type patchPayload struct {
+	Base    uint64                 `json:"base"`
+	Version uint64                 `json:"version"`
+	Patch   map[string]interface{} `json:"patch"`
+}
+
+// toGeneric converts v into the same shape as client sees.
+func toGeneric(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	return m, json.Unmarshal(b, &m)
+}
+
+// mergePatch returns patch which turns prev into next.
+func mergePatch(prev, next map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for k, nv := range next {
+		pv, found := prev[k]
+		if !found {
+			patch[k] = nv
+			continue
+		}
+		nm, nextIsMap := nv.(map[string]interface{})
+		pm, prevIsMap := pv.(map[string]interface{})
+		if nextIsMap && prevIsMap {
+			if sub := mergePatch(pm, nm); len(sub) > 0 {
+				patch[k] = sub
+			}
+			continue
+		}
+		if !reflect.DeepEqual(pv, nv) {
+			patch[k] = nv
+		}
+	}
+	for k := range prev {
+		if _, found := next[k]; !found {
+			patch[k] = nil
+		}
+	}
+	return patch
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// 1人で自分のペースでquizに回答する練習mode.
+// 状態はすべてdatastoreに置くので、matchと違ってどのreplicaでもrequestをうけられる.
+
+const (
+	practiceKind    = "PracticeSession"
+	practiceIDBytes = 16
+)
+
+// PracticeSession -
+type PracticeSession struct {
+	ID          string    `json:"id" datastore:"-"` // keyのname
+	UserID      string    `json:"user_id"`
+	CurrentQuiz int       `json:"current_quiz"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`     // 全問回答したら記録する
+	Daily       string    `json:"daily,omitempty"` // daily challengeの場合はその日付
+	Async       string    `json:"async,omitempty"` // 非同期matchの場合はそのid
+	ClosesAt    time.Time `json:"closes_at"`       // zeroなら期限なし
+	// 1問あたりの制限時間. 0は無制限
+	TimeLimitSec int          `json:"time_limit_sec"`
+	ShownAt      time.Time    `json:"shown_at"` // 出題中のquizを表示した時刻. zeroならまだ表示していない
+	User         *User        `json:"-" datastore:"-"`
+	Quizzes      []*Quiz      `json:"-" datastore:"-"`
+	Results      []QuizResult `json:"-" datastore:"-"`
+	// datastoreはnestしたsliceを扱えないのでjsonで保存する
+	Detail []byte `json:"-" datastore:",noindex"`
+}
+
+type practiceDetail struct {
+	User    *User        `json:"user"`
+	Quizzes []*Quiz      `json:"quizzes"` // 途中でquizが編集されても同じ問題を出すため本体ごと保存する
+	Results []QuizResult `json:"results"`
+}
+
+func (s *PracticeSession) encodeDetail() error {
+	detail, err := json.Marshal(&practiceDetail{User: s.User, Quizzes: s.Quizzes, Results: s.Results})
+	s.Detail = detail
+	return err
+}
+
+func (s *PracticeSession) decodeDetail() error {
+	var detail practiceDetail
+	if err := json.Unmarshal(s.Detail, &detail); err != nil {
+		return err
+	}
+	s.User, s.Quizzes, s.Results = detail.User, detail.Quizzes, detail.Results
+	if s.User == nil {
+		s.User = &User{ID: s.UserID}
+	}
+	return nil
+}
+
+func (s *PracticeSession) finished() bool {
+	return s.CurrentQuiz >= len(s.Quizzes)
+}
+
+// deadline returns when current quiz closes. zero if no time limit.
+func (s *PracticeSession) deadline() time.Time {
+	if s.TimeLimitSec == 0 || s.ShownAt.IsZero() {
+		return time.Time{}
+	}
+	return s.ShownAt.Add(time.Duration(s.TimeLimitSec) * time.Second)
+}
+
+// expire skips current quiz if its time limit has passed.
+// 次のquizは表示されるまで時間を数えない.
+func (s *PracticeSession) expire(now time.Time) bool {
+	deadline := s.deadline()
+	if s.finished() || deadline.IsZero() || now.Before(deadline) {
+		return false
+	}
+	s.Results[s.CurrentQuiz] = QuizResult{QuizIdx: s.CurrentQuiz}
+	s.CurrentQuiz++
+	s.ShownAt = time.Time{}
+	if s.finished() {
+		s.FinishedAt = now
+	}
+	return true
+}
+
+// closeDaily finishes attempt of daily challenge whose date is over.
+// 日付が変わると正解が公開されるので残りは未回答とし、挑戦した日付の結果として記録する.
+func (s *PracticeSession) closeDaily(now time.Time) bool {
+	if s.Daily == "" || s.finished() || s.Daily == dailyDate(now) {
+		return false
+	}
+	for i := s.CurrentQuiz; i < len(s.Quizzes); i++ {
+		s.Results[i] = QuizResult{QuizIdx: i}
+	}
+	s.CurrentQuiz = len(s.Quizzes)
+	s.ShownAt = time.Time{}
+	s.FinishedAt = now
+	return true
+}
+
+// show starts timer of current quiz.
+func (s *PracticeSession) show(now time.Time) {
+	if !s.finished() && s.ShownAt.IsZero() {
+		s.ShownAt = now
+	}
+}
+
+func (s *PracticeSession) score() int {
+	var score int
+	for _, r := range s.Results {
+		score += r.Points
+	}
+	return score
+}
+
+// player converts session to PlayerResult. 回答しなかったquizは未回答になる.
+func (s *PracticeSession) player(user *User) *PlayerResult {
+	p := &PlayerResult{User: user, Score: s.score(), Rank: 1}
+	for i, r := range s.Results {
+		sub := SubmissionResult{QuizIdx: i, QuizID: s.Quizzes[i].ID, Submitted: r.OptionSubmitted}
+		if r.OptionSubmitted {
+			sub.OptionIdx, sub.Correct, sub.Points, sub.SubmittedAt = r.OptionIdx, r.Correct, r.Points, r.SubmittedAt
+			sub.AnswerTimeMS = int64(r.AnswerTime / time.Millisecond)
+		}
+		p.Submissions = append(p.Submissions, sub)
+	}
+	return p
+}
+
+// result converts finished session to MatchResult so that it appears in history.
+func (s *PracticeSession) result(user *User) *MatchResult {
+	p := s.player(user)
+	mode := resultModePractice
+	if s.Daily != "" {
+		mode = resultModeDaily
+	}
+	return &MatchResult{
+		MatchID:      mode + "-" + s.ID,
+		Mode:         mode,
+		Host:         user.ID,
+		Visibility:   visibilityPrivate,
+		Participants: []string{user.ID},
+		StartedAt:    s.StartedAt,
+		FinishedAt:   s.FinishedAt,
+		Quizzes:      s.Quizzes,
+		Players:      []*PlayerResult{p},
+	}
+}
+
+// practiceView is session as seen by the user.
+type practiceView struct {
+	ID       string     `json:"id"`
+	QuizIdx  int        `json:"quiz_idx"`
+	QuizNum  int        `json:"quiz_num"`
+	Score    int        `json:"score"` // async matchでは結果をまとめるまで0
+	Finished bool       `json:"finished"`
+	Quiz     *QuizView  `json:"quiz"` // 次に回答するquiz. 終了後と、制限時間のあるquizを表示する前はnil
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+func (s *PracticeSession) view() *practiceView {
+	v := &practiceView{
+		ID:       s.ID,
+		QuizIdx:  s.CurrentQuiz,
+		QuizNum:  len(s.Quizzes),
+		Finished: s.finished(),
+	}
+	if s.revealsAnswers() {
+		v.Score = s.score()
+	}
+	// 時間を数え始める前に問題を見られないようにする
+	if !v.Finished && (s.TimeLimitSec == 0 || !s.ShownAt.IsZero()) {
+		v.Quiz = newQuizView(s.Quizzes[s.CurrentQuiz], false)
+	}
+	if deadline := s.deadline(); !deadline.IsZero() && !v.Finished {
+		v.Deadline = &deadline
+	}
+	return v
+}
+
+// revealsAnswers reports whether answers are shown right after submission.
+// async matchは他のplayerが解き終わるまで正解を伏せ、結果をまとめた後はreviewで見せる.
+func (s *PracticeSession) revealsAnswers() bool {
+	return s.Async == ""
+}
+
+// practiceAnswer is response to submission. 正解と解説をすぐに返す.
+type practiceAnswer struct {
+	Result            QuizResult    `json:"result"`                  // async matchでは正誤を含まない
+	Quiz              *QuizView     `json:"quiz"`                    // 正解を含む. async matchでは含まない
+	AnswerDescription string        `json:"answer_description_html"` // async matchでは空
+	Next              *practiceView `json:"next"`
+}
+
+type practiceInput struct {
+	QuizNum      int      `json:"quiz_num"`
+	Tags         []string `json:"tags"`
+	Difficulties []string `json:"difficulties"`
+}
+
+func readPracticeInput(r *http.Request) (*practiceInput, error) {
+	defer r.Body.Close()
+	var in practiceInput
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil && err != io.EOF {
+		return nil, newAPIError(errCodeInvalidRequest, err.Error())
+	}
+	if in.QuizNum == 0 {
+		in.QuizNum = defaultQuizNum
+	}
+	if in.QuizNum < 1 || in.QuizNum > maxQuizNum {
+		return nil, newAPIError(errCodeInvalidConfig, "quiz_num must be 1 to 50")
+	}
+	for _, d := range in.Difficulties {
+		if !isDifficultyLevel(d) {
+			return nil, newAPIError(errCodeInvalidConfig, "unknown difficulty "+d)
+		}
+	}
+	return &in, nil
+}
+
+// PracticeHandler -
+type PracticeHandler struct {
+	datastore *datastore.Client
+	logger    *zap.Logger
+	qh        *QuizHandler
+	store     *MatchStore
+}
+
+// Start creates session with quizzes picked by the sampler.
+func (ph *PracticeHandler) Start(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	in, err := readPracticeInput(r)
+	if err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: err})
+		return
+	}
+	quizzes, err := ph.qh.PickupFromStorage(r.Context(), &PickupInput{Max: in.QuizNum, Tags: in.Tags, Difficulties: in.Difficulties})
+	if err != nil {
+		ph.logger.Error("practice pickup", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	if len(quizzes) == 0 {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeNotEnoughQuiz, "no quiz matched the config")})
+		return
+	}
+	id, err := randomHex(practiceIDBytes)
+	if err != nil {
+		ph.logger.Error("practice id", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+
+	s := &PracticeSession{
+		ID:        id,
+		UserID:    user.ID,
+		StartedAt: time.Now(),
+		User:      user,
+		Quizzes:   quizzes,
+		Results:   make([]QuizResult, len(quizzes)),
+	}
+	s.show(s.StartedAt)
+	if err := s.encodeDetail(); err != nil {
+		ph.logger.Error("practice encode", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	if _, err := ph.datastore.Put(r.Context(), datastore.NameKey(practiceKind, id, nil), s); err != nil {
+		ph.logger.Error("practice save", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	ph.logger.Info("practice started", zap.String("id", id), zap.String("user", user.ID), zap.Int("quiz_num", len(quizzes)))
+	(&apiResponse{Data: s.view()}).write(w)
+}
+
+// Get returns current quiz of the session.
+func (ph *PracticeHandler) Get(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	s, err := ph.fetch(r.Context(), params.ByName("id"))
+	// 他のuserのsessionは存在を知られないように404にする
+	if err == datastore.ErrNoSuchEntity || (err == nil && s.UserID != user.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ph.logger.Error("practice fetch", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	(&apiResponse{Data: s.view()}).write(w)
+}
+
+// Answer judges submission to current quiz and returns explanation.
+// 最後の問題に回答したら結果をhistoryに記録する.
+func (ph *PracticeHandler) Answer(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	var sub submission
+	err := json.NewDecoder(r.Body).Decode(&sub)
+	r.Body.Close()
+	if err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeInvalidRequest, err.Error())})
+		return
+	}
+
+	var s *PracticeSession
+	var timedOut bool
+	k := datastore.NameKey(practiceKind, params.ByName("id"), nil)
+	// 同じ問題への回答が同時に届いても1回だけ数える
+	_, err = ph.datastore.RunInTransaction(r.Context(), func(tx *datastore.Transaction) error {
+		s = &PracticeSession{}
+		if err := tx.Get(k, s); err != nil {
+			return err
+		}
+		s.ID = k.Name
+		if s.UserID != user.ID {
+			return datastore.ErrNoSuchEntity
+		}
+		if err := s.decodeDetail(); err != nil {
+			return err
+		}
+		now := time.Now()
+		// 制限時間を過ぎていたら回答は受けつけず、次のquizへ進めたことだけ保存する
+		// daily challengeの日付が変わっていたら、そこで終えたことにする
+		if timedOut = s.closeDaily(now) || s.expire(now); !timedOut {
+			if err := s.answer(&sub, now); err != nil {
+				return err
+			}
+		}
+		if err := s.encodeDetail(); err != nil {
+			return err
+		}
+		_, err := tx.Put(k, s)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if apiErr, ok := err.(*apiError); ok {
+		fail(w, http.StatusConflict, &apiResponse{Err: apiErr})
+		return
+	}
+	if err != nil {
+		ph.logger.Error("practice answer", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+
+	if s.finished() {
+		ph.record(user, s)
+	}
+	if timedOut {
+		fail(w, http.StatusConflict, &apiResponse{Data: s.view(), Err: newAPIError(errCodeQuizClosed, "time is up")})
+		return
+	}
+
+	quiz := s.Quizzes[sub.QuizIdx]
+	res := &practiceAnswer{Result: s.Results[sub.QuizIdx], Next: s.view()}
+	// async matchの回答は期限前か全員が解き終わる前にしか届かないので、正解は常に伏せる
+	if !s.revealsAnswers() {
+		res.Result.Correct, res.Result.Points = false, 0
+		res.Quiz = newQuizView(quiz, false)
+		(&apiResponse{Data: res}).write(w)
+		return
+	}
+	description, err := SyntaxHighlight((&Markdown{}).ConvertHTML([]byte(quiz.AnswerDescription)))
+	if err != nil {
+		ph.logger.Error("practice answer description", zap.Error(err))
+	}
+	res.Quiz = newQuizView(quiz, true)
+	res.AnswerDescription = string(description)
+	(&apiResponse{Data: res}).write(w)
+}
+
+// answer records submission to current quiz and moves to next one.
+func (s *PracticeSession) answer(sub *submission, now time.Time) error {
+	if s.finished() {
+		return newAPIError(errCodeQuizClosed, "practice is already finished")
+	}
+	if !s.ClosesAt.IsZero() && now.After(s.ClosesAt) {
+		return newAPIError(errCodeQuizClosed, "match is already over")
+	}
+	// 表示する前のquizには回答できない
+	if s.TimeLimitSec > 0 && s.ShownAt.IsZero() {
+		return newAPIError(errCodeQuizClosed, "quiz is not shown yet")
+	}
+	// 回答済みの問題には戻れない
+	if sub.QuizIdx != s.CurrentQuiz {
+		return newAPIError(errCodeInvalidQuizIdx, "answer the current quiz")
+	}
+	quiz := s.Quizzes[sub.QuizIdx]
+	r := QuizResult{QuizIdx: sub.QuizIdx, OptionIdx: sub.OptionIdx}
+	valid := false
+	for _, opt := range quiz.Options {
+		if opt.Index == sub.OptionIdx {
+			valid, r.Correct = true, opt.IsAnswer
+		}
+	}
+	if !valid {
+		return newAPIError(errCodeInvalidOption, "choose one of the options")
+	}
+	r.OptionSubmitted = true
+	r.SubmittedAt = now
+	// 以前のsessionはShownAtをもたないので、前の問題に回答してから(最初の問題は開始してから)の時間
+	shownAt := s.ShownAt
+	if shownAt.IsZero() {
+		shownAt = s.StartedAt
+		if sub.QuizIdx > 0 {
+			shownAt = s.Results[sub.QuizIdx-1].SubmittedAt
+		}
+	}
+	r.AnswerTime = r.SubmittedAt.Sub(shownAt)
+	if r.Correct {
+		r.Points = pointsPerQuiz
+	}
+	s.Results[sub.QuizIdx] = r
+	s.CurrentQuiz++
+	// 次のquizは回答のresponseで表示する
+	s.ShownAt = time.Time{}
+	s.show(now)
+	if s.finished() {
+		s.FinishedAt = now
+	}
+	return nil
+}
+
+// record saves result of finished session in background.
+// 練習なのでratingやleaderboardには反映せず、historyとquizの集計、復習queueだけに記録する.
+func (ph *PracticeHandler) record(user *User, s *PracticeSession) {
+	// 非同期matchは全員の結果が揃ってからまとめて記録する
+	if s.Async != "" {
+		go ph.finishAsyncIfDone(s.Async)
+		return
+	}
+	res := s.result(user)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), matchSaveTimeout)
+		defer cancel()
+		if err := ph.store.SaveResult(ctx, res); err != nil {
+			ph.logger.Error("save practice result", zap.Error(err))
+			return
+		}
+		if err := ph.qh.RecordStats(ctx, res); err != nil {
+			ph.logger.Error("record stats", zap.Error(err))
+		}
+		if err := ph.qh.reviews.RecordMatch(ctx, res); err != nil {
+			ph.logger.Error("record reviews", zap.Error(err))
+		}
+		if s.Daily != "" {
+			if err := ph.recordDaily(ctx, user, s.Daily, res); err != nil {
+				ph.logger.Error("record daily", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// userSessionID returns id of user's attempt in scope. 1人1回なのでuserとscope(日付やmatch)から決める.
+func userSessionID(scope, userID string) string {
+	return scope + "-" + strings.Replace(userID, ":", "-", -1)
+}
+
+func (ph *PracticeHandler) fetch(ctx context.Context, id string) (*PracticeSession, error) {
+	var s PracticeSession
+	if err := ph.datastore.Get(ctx, datastore.NameKey(practiceKind, id, nil), &s); err != nil {
+		return nil, err
+	}
+	s.ID = id
+	return &s, s.decodeDetail()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// async matchでは回答しても、結果をまとめるまで点数から正誤がわからない.
+func TestAsyncSessionHidesScore(t *testing.T) {
+	quizzes := []*Quiz{
+		{ID: "q0", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}},
+		{ID: "q1", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}},
+	}
+	for _, async := range []string{"", "m"} {
+		now := time.Now()
+		s := &PracticeSession{StartedAt: now, Async: async, Quizzes: quizzes, Results: make([]QuizResult, len(quizzes))}
+		if err := s.answer(&submission{QuizIdx: 0, OptionIdx: 0}, now); err != nil {
+			t.Fatal(err)
+		}
+		want := pointsPerQuiz
+		if async != "" {
+			want = 0
+		}
+		if score := s.view().Score; score != want {
+			t.Fatalf("async %q: score = %d, want %d", async, score, want)
+		}
+	}
+}
+
+// 日付をまたいだdaily challengeは、挑戦した日付の結果として終える.
+func TestDailyClosesAfterDateChanges(t *testing.T) {
+	quizzes := []*Quiz{
+		{ID: "q0", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}},
+		{ID: "q1", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}},
+	}
+	started := time.Date(2020, 1, 1, 23, 59, 0, 0, dailyLocation)
+	s := &PracticeSession{StartedAt: started, Daily: dailyDate(started), Quizzes: quizzes, Results: make([]QuizResult, len(quizzes))}
+	if s.closeDaily(started) {
+		t.Fatal("attempt must not close on the same date")
+	}
+	if err := s.answer(&submission{QuizIdx: 0, OptionIdx: 0}, started); err != nil {
+		t.Fatal(err)
+	}
+
+	next := started.Add(2 * time.Minute)
+	if !s.closeDaily(next) || !s.finished() {
+		t.Fatal("attempt must close after the date changes")
+	}
+	if s.Results[1].OptionSubmitted {
+		t.Fatalf("rest must be unanswered: %+v", s.Results[1])
+	}
+	res := s.result(&User{ID: "u"})
+	if res.Mode != resultModeDaily || res.Players[0].Score != pointsPerQuiz || !res.FinishedAt.Equal(next) {
+		t.Fatalf("result = %+v, score %d", res, res.Players[0].Score)
+	}
+	if s.Daily != "2020-01-01" {
+		t.Fatalf("daily = %s", s.Daily)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// 大画面に映すためのpresenter表示. playerとして参加していないspectatorと同じものに加え、
+// 回答数、直前に正解を発表したquizの選択肢ごとの回答数、順位表を送る.
+// 締め切り前の回答は会場のplayerに見えてしまうので、誰が何を選んだかは見せない.
+
+// AnswerCountView is how many players answered current quiz.
+type AnswerCountView struct {
+	Answered int `json:"answered"`
+	Players  int `json:"players"`
+}
+
+// RevealView is latest quiz whose answer has been revealed.
+type RevealView struct {
+	QuizIdx      int       `json:"quiz_idx"`
+	Quiz         *QuizView `json:"quiz"`         // 正解を含む
+	Distribution []int     `json:"distribution"` // Quiz.Optionsの順に、選んだplayerの数
+	Answered     int       `json:"answered"`
+	Correct      int       `json:"correct"`
+}
+
+// RankView is row of leaderboard.
+type RankView struct {
+	User  *User  `json:"user"`
+	Team  string `json:"team,omitempty"`
+	Score int    `json:"score"`
+	Rank  int    `json:"rank"` // 同点は同じrank
+}
+
+func (s *State) presenterView(v *StateView) {
+	m := s.match
+	if v.Phase == phaseQuestion {
+		c := &AnswerCountView{Players: len(s.Contexts)}
+		for _, ctx := range s.Contexts {
+			if s.QuizIdx < len(ctx.Results) && ctx.Results[s.QuizIdx].OptionSubmitted {
+				c.Answered++
+			}
+		}
+		v.AnswerCount = c
+	}
+
+	// 出題中のquizより前で、正解を発表した最後のquiz. 終了後は最後のquiz
+	for i := s.QuizIdx; i >= 0; i-- {
+		if i >= len(m.quizzes) || !m.quizeAnswerVisibilities[i] {
+			continue
+		}
+		if i == s.QuizIdx && v.Phase != phaseFinished {
+			continue
+		}
+		v.Reveal = s.reveal(i)
+		break
+	}
+
+	for _, p := range v.Players {
+		v.Leaderboard = append(v.Leaderboard, &RankView{User: p.User, Team: p.Team, Score: p.Score})
+	}
+	sort.SliceStable(v.Leaderboard, func(i, j int) bool {
+		a, b := v.Leaderboard[i], v.Leaderboard[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.User.Name < b.User.Name
+	})
+	for i, r := range v.Leaderboard {
+		r.Rank = i + 1
+		if i > 0 && v.Leaderboard[i-1].Score == r.Score {
+			r.Rank = v.Leaderboard[i-1].Rank
+		}
+	}
+}
+
+func (s *State) reveal(quizIdx int) *RevealView {
+	quiz := s.match.quizzes[quizIdx]
+	r := &RevealView{QuizIdx: quizIdx, Quiz: newQuizView(quiz, true), Distribution: make([]int, len(quiz.Options))}
+	position := make(map[int]int, len(quiz.Options))
+	for i, opt := range quiz.Options {
+		position[opt.Index] = i
+	}
+	for _, ctx := range s.Contexts {
+		if quizIdx >= len(ctx.Results) || !ctx.Results[quizIdx].OptionSubmitted {
+			continue
+		}
+		qr := ctx.Results[quizIdx]
+		r.Answered++
+		if qr.Correct {
+			r.Correct++
+		}
+		if i, found := position[qr.OptionIdx]; found {
+			r.Distribution[i]++
+		}
+	}
+	return r
+}
+
+// ServePresenter connects presenter client. playerにはならず、回答もできない.
+func (mg *MatchGroup) ServePresenter(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	mg.serveWS(w, r, params, true)
+}
+
+// RenderPresenter -
+func (mg *MatchGroup) RenderPresenter(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	m, found := mg.lookup(params.ByName("id"))
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	user, found := UserFromReq(r)
+	if !found {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !m.isAdmitted(user) {
+		redirect(w, r, "/join/"+m.code)
+		return
+	}
+
+	err := mg.ts.ExecuteTemplate(w, "presenter", struct {
+		WSURL string
+	}{
+		WSURL: wsEndpointBase(),
+	})
+	if err != nil {
+		mg.logger.Error("render presenter", zap.Error(err))
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// playerとして参加しているuserがpresenterを開いても、本人の回答は締め切りまで映らない.
+func TestPresenterViewIsAnonymous(t *testing.T) {
+	quizzes := []*Quiz{{ID: "q0", Options: []*Option{{Index: 0, IsAnswer: true}, {Index: 1}}}}
+	m := buildMatch("m", &MatchConfig{RevealPolicy: revealImmediate}, quizzes, nil, zap.NewNop())
+	player := &User{ID: "p", Name: "p"}
+	m.join(player, "")
+	m.Start()
+	if err := m.handleSubmission(player, &submission{QuizIdx: 0, OptionIdx: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	presenter := &Client{user: player, presenter: true}
+	role := m.clientRole(presenter)
+	v := m.state().viewFor(m.viewerOf(presenter, role), role)
+	p := v.Players["p"]
+	if p.Results[0].OptionIdx != nil || p.Score != 0 {
+		t.Fatalf("presenter sees choice %v, score %d", p.Results[0].OptionIdx, p.Score)
+	}
+	if len(v.Leaderboard) != 1 || v.Leaderboard[0].Score != 0 {
+		t.Fatalf("leaderboard = %+v", v.Leaderboard[0])
+	}
+	if v.AnswerCount == nil || v.AnswerCount.Answered != 1 {
+		t.Fatalf("answer count = %+v", v.AnswerCount)
+	}
+
+	// 同じuserのplayerとしての接続には本人の回答を見せる
+	own := m.state().viewFor(m.viewerOf(&Client{user: player}, viewerPlayer), viewerPlayer)
+	if own.Players["p"].Score != pointsPerQuiz {
+		t.Fatalf("player score = %d", own.Players["p"].Score)
+	}
+}
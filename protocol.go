@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// websocketでやりとりするmessageのversion. 互換性のない変更をしたらあげる.
+const protocolVersion = 1
+
+// client => server
+const (
+	msgJoin        = "join"         // playerとして参加する
+	msgSubmit      = "submit"       // 回答
+	msgReady       = "ready"        // 開始前の準備完了
+	msgHeartbeat   = "heartbeat"    // 接続確認
+	msgChat        = "chat"         // server => clientのbroadcastにも使う
+	msgHostControl = "host_control" // hostによるmatchの操作
+	msgSync        = "sync"         // stateの全体を要求する
+	msgResume      = "resume"       // 再接続したplayerが元のsessionに戻る
+	msgTeam        = "team"         // 開始前に所属するteamを変える
+)
+
+// server => client
+const (
+	msgAck   = "ack"
+	msgError = "error"
+	msgState = "state" // stateの全体
+	msgPatch = "patch" // 前回送ったstateとの差分
+)
+
+const (
+	maxMessageSize   = 4096
+	maxChatLength    = 200
+	resumeTokenBytes = 16
+)
+
+const (
+	errCodeMalformedFrame     = "malformed_frame"
+	errCodeUnsupportedVersion = "unsupported_version"
+	errCodeUnknownType        = "unknown_type"
+	errCodeMatchFull          = "match_full"
+	errCodeNotHost            = "not_host"
+	errCodeInvalidAction      = "invalid_action"
+	errCodeInvalidState       = "invalid_state" // matchの状態ではできない操作
+	errCodeInvalidChat        = "invalid_chat"
+	errCodeInvalidResumeToken = "invalid_resume_token"
+	errCodeInvalidTeam        = "invalid_team"
+	errCodeNotCaptain         = "not_captain"
+	errCodeReadOnly           = "read_only"
+	errCodeMatchPaused        = "match_paused"
+	errCodeKicked             = "kicked"
+	errCodeBanned             = "banned"
+)
+
+// frame is envelope of every websocket message.
+type frame struct {
+	V         int             `json:"v"`
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id,omitempty"` // client側で採番. ack/errorで返す
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+type submitPayload = submission
+
+// joinPayload is optional. team戦でteamを省略した場合は人数の少ないteamに入る.
+type joinPayload struct {
+	Team string `json:"team"`
+}
+
+type teamPayload struct {
+	Team string `json:"team"`
+}
+
+type readyPayload struct {
+	Ready bool `json:"ready"`
+}
+
+type chatPayload struct {
+	Text string `json:"text"`
+}
+
+type hostControlPayload struct {
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"` // kick/banの対象のuser.ID
+}
+
+type resumePayload struct {
+	Token string `json:"token"`
+}
+
+type joinAck struct {
+	Host        bool   `json:"host"`
+	ResumeToken string `json:"resume_token"`
+}
+
+type heartbeatAck struct {
+	ServerTime time.Time `json:"server_time"`
+}
+
+type chatBroadcast struct {
+	User   *User     `json:"user"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// inbound is decoded client message passed to Match.run.
+// decodeに失敗した場合はerrにclientへ返すerrorが入っている.
+type inbound struct {
+	client *Client
+	frame  *frame
+	err    *apiError
+}
+
+// decodeFrame parses raw websocket message.
+func decodeFrame(raw []byte) (*frame, *apiError) {
+	var f frame
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, newAPIError(errCodeMalformedFrame, err.Error())
+	}
+	if f.V != protocolVersion {
+		return &f, newAPIError(errCodeUnsupportedVersion, "protocol version must be 1")
+	}
+	if f.Type == "" {
+		return &f, newAPIError(errCodeMalformedFrame, "type is required")
+	}
+	return &f, nil
+}
+
+// decodePayload unmarshals payload into v.
+func (f *frame) decodePayload(v interface{}) *apiError {
+	if len(f.Payload) == 0 {
+		return newAPIError(errCodeMalformedFrame, "payload is required")
+	}
+	if err := json.Unmarshal(f.Payload, v); err != nil {
+		return newAPIError(errCodeMalformedFrame, err.Error())
+	}
+	return nil
+}
+
+// encodeFrame builds outbound message.
+func encodeFrame(typ, requestID string, payload interface{}) []byte {
+	f := frame{V: protocolVersion, Type: typ, RequestID: requestID}
+	if payload != nil {
+		p, err := json.Marshal(payload)
+		if err != nil {
+			logger.Error("marshal payload", zap.String("type", typ), zap.Error(err))
+			return nil
+		}
+		f.Payload = p
+	}
+	encoded, err := json.Marshal(&f)
+	if err != nil {
+		logger.Error("marshal frame", zap.String("type", typ), zap.Error(err))
+		return nil
+	}
+	return encoded
+}
+
+func ackFrame(requestID string, payload interface{}) []byte {
+	return encodeFrame(msgAck, requestID, payload)
+}
+
+func errorFrame(requestID string, err error) []byte {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		apiErr = newAPIError("internal", err.Error())
+	}
+	return encodeFrame(msgError, requestID, apiErr)
+}
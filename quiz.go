@@ -25,6 +25,8 @@ type QuizHandler struct {
 	ts        *handlers.TemplateSet
 	datastore *datastore.Client
 	logger    *zap.Logger
+	users     *UserHandler
+	reviews   *ReviewQueue
 }
 
 // RenderQuizForm -
@@ -49,10 +51,32 @@ func (qh *QuizHandler) RenderQuizForm(w http.ResponseWriter, r *http.Request, pa
 type Quiz struct {
 	ID                string `json:"id"`
 	User              *User
-	DescriptionMD     string    `json:"description_md" datastore:",noindex"`
-	DescriptionHTML   string    `json:"description_html" datastore:",noindex"`
-	Options           []*Option `json:"options"`
-	AnswerDescription string    `json:"answer_description" datastore:",noindex"`
+	DescriptionMD     string     `json:"description_md" datastore:",noindex"`
+	DescriptionHTML   string     `json:"description_html" datastore:",noindex"`
+	Options           []*Option  `json:"options"`
+	AnswerDescription string     `json:"answer_description" datastore:",noindex"`
+	Tags              []string   `json:"tags"`
+	Stats             *QuizStats `json:"stats,omitempty" datastore:"-"` // Getの場合のみ
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Quiz) hasAnyTag(tags []string) bool {
+	for _, want := range tags {
+		for _, tag := range q.Tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // Option -
@@ -95,6 +119,11 @@ func (qh *QuizHandler) Save(w http.ResponseWriter, r *http.Request, params httpr
 	quiz.DescriptionHTML = string(syntaxed)
 
 	quiz, err = qh.PutToStorage(r.Context(), quiz)
+	if err == nil && encodedID == "" {
+		if err := qh.users.RecordQuiz(r.Context(), user); err != nil {
+			qh.logger.Error("record quiz", zap.Error(err))
+		}
+	}
 	(&apiResponse{Data: quiz, Err: err}).write(w)
 }
 
@@ -102,6 +131,9 @@ func (qh *QuizHandler) Save(w http.ResponseWriter, r *http.Request, params httpr
 func (qh *QuizHandler) Get(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	encodedID := params.ByName("id")
 	quiz, err := qh.FetchFromStorage(r.Context(), encodedID)
+	if err == nil {
+		quiz.Stats, err = qh.FetchStats(r.Context(), encodedID)
+	}
 	(&apiResponse{Data: quiz, Err: err}).write(w)
 }
 
@@ -137,6 +169,33 @@ func unauthorized(w http.ResponseWriter) {
 	fail(w, http.StatusUnauthorized, &apiResponse{})
 }
 
+const (
+	errCodeInvalidRequest = "invalid_request"
+	errCodeInvalidConfig  = "invalid_config"
+	errCodeQuizNotFound   = "quiz_not_found"
+	errCodeNotEnoughQuiz  = "not_enough_quiz"
+
+	errCodeNotParticipant   = "not_participant"
+	errCodeInvalidQuizIdx   = "invalid_quiz_idx"
+	errCodeInvalidOption    = "invalid_option"
+	errCodeQuizClosed       = "quiz_closed"
+	errCodeAlreadySubmitted = "already_submitted"
+)
+
+// apiError is error which client can handle by its code.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newAPIError(code, msg string) *apiError {
+	return &apiError{Code: code, Message: msg}
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
 // storage operation
 
 const (
@@ -180,12 +239,28 @@ func (qh *QuizHandler) FetchFromStorage(ctx context.Context, encodedID string) (
 
 // PickupInput -
 type PickupInput struct {
-	Max int
+	Max          int
+	IDs          []string // 指定された場合はこの順で返す
+	Tags         []string // いずれかのtagをもつquizに絞る
+	Difficulties []string // いずれかの難易度のquizに絞る
+	TargetRating float64  // 0でなければratingが近いquizを選ぶ
 }
 
 // PickupFromStorage -
 // 全部とって、randomで返す. 複数取得とpickupする処理はわけたほうがよかった.
 func (qh *QuizHandler) PickupFromStorage(ctx context.Context, input *PickupInput) ([]*Quiz, error) {
+	if len(input.IDs) > 0 {
+		return qh.fetchByIDs(ctx, input.IDs)
+	}
+
+	var stats map[string]*QuizStats
+	if len(input.Difficulties) > 0 || input.TargetRating > 0 {
+		var err error
+		if stats, err = qh.allStats(ctx); err != nil {
+			return nil, err
+		}
+	}
+
 	q := datastore.NewQuery(quizKind)
 	itr := qh.datastore.Run(ctx, q)
 
@@ -199,13 +274,41 @@ func (qh *QuizHandler) PickupFromStorage(ctx context.Context, input *PickupInput
 		if err != nil {
 			return nil, err
 		}
+		if len(input.Tags) > 0 && !quiz.hasAnyTag(input.Tags) {
+			continue
+		}
 		quiz.ID = k.Encode()
+		if len(input.Difficulties) > 0 && !containsString(input.Difficulties, difficultyOf(stats, quiz.ID)) {
+			continue
+		}
 		quizzes = append(quizzes, &quiz) // このaddressing 大丈夫?
 	}
 
+	if input.TargetRating > 0 {
+		picked, _ := qh.pickup(quizzes, len(quizzes))
+		return pickupNear(picked, stats, input.TargetRating, input.Max), nil
+	}
 	return qh.pickup(quizzes, input.Max)
 }
 
+func (qh *QuizHandler) fetchByIDs(ctx context.Context, ids []string) ([]*Quiz, error) {
+	quizzes := make([]*Quiz, 0, len(ids))
+	for _, id := range ids {
+		if _, err := datastore.DecodeKey(id); err != nil {
+			return nil, newAPIError(errCodeInvalidConfig, "invalid quiz id "+id)
+		}
+		quiz, err := qh.FetchFromStorage(ctx, id)
+		if err == datastore.ErrNoSuchEntity {
+			return nil, newAPIError(errCodeQuizNotFound, "quiz "+id+" not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		quizzes = append(quizzes, quiz)
+	}
+	return quizzes, nil
+}
+
 func (qh *QuizHandler) pickup(quizzes []*Quiz, n int) ([]*Quiz, error) {
 	rand.Shuffle(len(quizzes), func(i, j int) {
 		quizzes[i], quizzes[j] = quizzes[j], quizzes[i]
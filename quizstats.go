@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// quizごとの集計. matchの結果を保存するたびに加算していく.
+
+const (
+	quizStatsKind = "QuizStats"
+	// 回答時間は1秒ごとに数える. これより遅い回答は最後のbucketにいれる
+	maxAnswerTimeSec = maxTimeLimit
+	// 回答数がこれより少ないquizは難易度を決めない
+	minAnswersForDifficulty = 5
+)
+
+// 難易度
+const (
+	difficultyEasy    = "easy"
+	difficultyNormal  = "normal"
+	difficultyHard    = "hard"
+	difficultyUnrated = "unrated" // まだ回答が少ない
+)
+
+// QuizStats is aggregated result of a quiz.
+type QuizStats struct {
+	QuizID       string    `json:"quiz_id" datastore:"-"` // keyのname
+	Played       int       `json:"played"`                // 出題されたmatchの数
+	Answered     int       `json:"answered"`
+	Correct      int       `json:"correct"`
+	OptionCounts []int     `json:"option_counts" datastore:",noindex"` // 各選択肢が選ばれた回数. 誤答が集まる選択肢を見つけるため
+	AnswerTimes  []int     `json:"-" datastore:",noindex"`             // 回答までの秒数ごとの回答数
+	Rating       float64   `json:"rating"`                             // Elo rating. 高いほど難しい
+	Rated        int       `json:"rated"`                              // ratingに反映した回答数
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	// 以下は上から計算する
+	CorrectRate     float64 `json:"correct_rate" datastore:"-"`
+	MedianAnswerSec int     `json:"median_answer_sec" datastore:"-"`
+	Difficulty      float64 `json:"difficulty" datastore:"-"` // 0(易)から1(難)
+	DifficultyLevel string  `json:"difficulty_level" datastore:"-"`
+}
+
+func (s *QuizStats) add(optionNum int, sub SubmissionResult) {
+	if !sub.Submitted {
+		return
+	}
+	s.Answered++
+	if sub.Correct {
+		s.Correct++
+	}
+	if len(s.OptionCounts) < optionNum {
+		s.OptionCounts = append(s.OptionCounts, make([]int, optionNum-len(s.OptionCounts))...)
+	}
+	if sub.OptionIdx >= 0 && sub.OptionIdx < len(s.OptionCounts) {
+		s.OptionCounts[sub.OptionIdx]++
+	}
+	if len(s.AnswerTimes) == 0 {
+		s.AnswerTimes = make([]int, maxAnswerTimeSec+1)
+	}
+	sec := int(sub.AnswerTimeMS / 1000)
+	if sec > maxAnswerTimeSec {
+		sec = maxAnswerTimeSec
+	}
+	s.AnswerTimes[sec]++
+}
+
+// derive fills computed fields.
+// 難易度は正解率を主に、回答にかかった時間を少しだけ加味する.
+func (s *QuizStats) derive() {
+	if s.Rated == 0 {
+		s.Rating = initialRating
+	}
+	s.DifficultyLevel = difficultyUnrated
+	if s.Answered == 0 {
+		return
+	}
+	s.CorrectRate = float64(s.Correct) / float64(s.Answered)
+	s.MedianAnswerSec = medianBucket(s.AnswerTimes, s.Answered)
+	if s.Answered < minAnswersForDifficulty {
+		return
+	}
+
+	slowness := float64(s.MedianAnswerSec) / 30
+	if slowness > 1 {
+		slowness = 1
+	}
+	s.Difficulty = 0.8*(1-s.CorrectRate) + 0.2*slowness
+	switch {
+	case s.Difficulty < 0.3:
+		s.DifficultyLevel = difficultyEasy
+	case s.Difficulty < 0.6:
+		s.DifficultyLevel = difficultyNormal
+	default:
+		s.DifficultyLevel = difficultyHard
+	}
+}
+
+func medianBucket(buckets []int, total int) int {
+	var n int
+	for i, c := range buckets {
+		n += c
+		if n*2 >= total {
+			return i
+		}
+	}
+	return 0
+}
+
+func isDifficultyLevel(level string) bool {
+	switch level {
+	case difficultyEasy, difficultyNormal, difficultyHard, difficultyUnrated:
+		return true
+	}
+	return false
+}
+
+// RecordStats adds match result to stats of each quiz.
+func (qh *QuizHandler) RecordStats(ctx context.Context, res *MatchResult) error {
+	for i, quiz := range res.Quizzes {
+		if quiz.ID == "" {
+			continue
+		}
+		err := qh.updateStats(ctx, quiz.ID, func(stats *QuizStats) {
+			stats.Played++
+			for _, p := range res.Players {
+				if i < len(p.Submissions) {
+					stats.add(len(quiz.Options), p.Submissions[i])
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (qh *QuizHandler) updateStats(ctx context.Context, quizID string, f func(stats *QuizStats)) error {
+	k := datastore.NameKey(quizStatsKind, quizID, nil)
+	_, err := qh.datastore.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var stats QuizStats
+		if err := tx.Get(k, &stats); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		f(&stats)
+		stats.UpdatedAt = time.Now()
+		_, err := tx.Put(k, &stats)
+		return err
+	})
+	return err
+}
+
+// FetchStats returns stats of the quiz. まだ出題されていなければ空の集計.
+func (qh *QuizHandler) FetchStats(ctx context.Context, quizID string) (*QuizStats, error) {
+	var stats QuizStats
+	err := qh.datastore.Get(ctx, datastore.NameKey(quizStatsKind, quizID, nil), &stats)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	stats.QuizID = quizID
+	stats.derive()
+	return &stats, nil
+}
+
+// allStats returns stats of every quiz. keyはquiz id.
+func (qh *QuizHandler) allStats(ctx context.Context) (map[string]*QuizStats, error) {
+	var list []*QuizStats
+	keys, err := qh.datastore.GetAll(ctx, datastore.NewQuery(quizStatsKind), &list)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]*QuizStats, len(keys))
+	for i, k := range keys {
+		list[i].QuizID = k.Name
+		list[i].derive()
+		stats[k.Name] = list[i]
+	}
+	return stats, nil
+}
+
+// difficultyOf returns level of quiz. 集計がなければunrated.
+func difficultyOf(stats map[string]*QuizStats, quizID string) string {
+	if s, found := stats[quizID]; found {
+		return s.DifficultyLevel
+	}
+	return difficultyUnrated
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Elo rating. 1回の回答をplayerとquizの対戦とみなし、正解ならplayerの勝ち、不正解ならquizの勝ちとする.
+// playerのratingは実力、quizのratingは難しさを表す.
+
+const (
+	initialRating = 1500
+	// 回答数が少ないうちは大きく動かす
+	playerK          = 32
+	provisionalK     = 48
+	provisionalRated = 20
+	// quizは多くのplayerに回答されるので小さめにする
+	quizK = 16
+	// matchmakingではこの幅ごとに近いquizを同じとみなし、その中ではrandomに選ぶ
+	matchmakingBucket = 100
+)
+
+// expectedScore returns probability that player answers correctly.
+func expectedScore(player, quiz float64) float64 {
+	return 1 / (1 + math.Pow(10, (quiz-player)/400))
+}
+
+func playerKFactor(rated int) float64 {
+	if rated < provisionalRated {
+		return provisionalK
+	}
+	return playerK
+}
+
+// RecordRatings updates ratings of players and quizzes from match result.
+// match開始時点のratingで全回答の変化量を計算してからまとめて加算する.
+func (qh *QuizHandler) RecordRatings(ctx context.Context, res *MatchResult) error {
+	players := make(map[string]*UserProfile, len(res.Players))
+	for _, p := range res.Players {
+		profile, err := qh.users.Fetch(ctx, p.User.ID)
+		if err == datastore.ErrNoSuchEntity {
+			profile = &UserProfile{Rating: initialRating}
+		} else if err != nil {
+			return err
+		}
+		players[p.User.ID] = profile
+	}
+	quizzes := make([]*QuizStats, len(res.Quizzes))
+	for i, quiz := range res.Quizzes {
+		stats, err := qh.FetchStats(ctx, quiz.ID)
+		if err != nil {
+			return err
+		}
+		quizzes[i] = stats
+	}
+
+	playerDelta := make(map[string]float64)
+	playerRated := make(map[string]int)
+	quizDelta := make([]float64, len(res.Quizzes))
+	quizRated := make([]int, len(res.Quizzes))
+	for _, p := range res.Players {
+		profile := players[p.User.ID]
+		for i, s := range p.Submissions {
+			// 回答しなかった問題は対戦していないものとする
+			if !s.Submitted || i >= len(quizzes) {
+				continue
+			}
+			var score float64
+			if s.Correct {
+				score = 1
+			}
+			expected := expectedScore(profile.Rating, quizzes[i].Rating)
+			playerDelta[p.User.ID] += playerKFactor(profile.Rated) * (score - expected)
+			playerRated[p.User.ID]++
+			quizDelta[i] += quizK * (expected - score)
+			quizRated[i]++
+		}
+	}
+
+	for id, delta := range playerDelta {
+		delta, rated := delta, playerRated[id]
+		err := qh.users.update(ctx, id, func(p *UserProfile) {
+			if p.Rated == 0 {
+				p.Rating = initialRating
+			}
+			p.Rating += delta
+			p.Rated += rated
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i, quiz := range res.Quizzes {
+		if quizRated[i] == 0 || quiz.ID == "" {
+			continue
+		}
+		delta, rated := quizDelta[i], quizRated[i]
+		err := qh.updateStats(ctx, quiz.ID, func(s *QuizStats) {
+			if s.Rated == 0 {
+				s.Rating = initialRating
+			}
+			s.Rating += delta
+			s.Rated += rated
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// averageRating returns average rating of the users. 未登録のuserは初期値で数える.
+func (qh *QuizHandler) averageRating(ctx context.Context, userIDs []string) (float64, error) {
+	if len(userIDs) == 0 {
+		return initialRating, nil
+	}
+	var sum float64
+	for _, id := range userIDs {
+		p, err := qh.users.Fetch(ctx, id)
+		if err == datastore.ErrNoSuchEntity {
+			sum += initialRating
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		sum += p.Rating
+	}
+	return sum / float64(len(userIDs)), nil
+}
+
+// pickupNear returns n quizzes whose ratings are close to target.
+func pickupNear(quizzes []*Quiz, stats map[string]*QuizStats, target float64, n int) []*Quiz {
+	distance := func(q *Quiz) int {
+		rating := float64(initialRating)
+		if s, found := stats[q.ID]; found {
+			rating = s.Rating
+		}
+		return int(math.Abs(rating-target)) / matchmakingBucket
+	}
+	// 事前にshuffleしてあるので、同じbucketの中では順番はrandom
+	sort.SliceStable(quizzes, func(i, j int) bool {
+		return distance(quizzes[i]) < distance(quizzes[j])
+	})
+	if len(quizzes) < n {
+		n = len(quizzes)
+	}
+	return quizzes[:n]
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 依存を増やさないように、必要なcommandだけを話す小さなRESP client.
+// redisと互換のあるserver(テスト用のstand-inを含む)であれば動く.
+
+const (
+	redisDialTimeout = 5 * time.Second
+	// ctxに期限がない場合のcommandの期限. redisが詰まってもmutexを持ったまま待ち続けないようにする
+	redisTimeout = 5 * time.Second
+)
+
+var errRedisNil = errors.New("redis: nil")
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient serializes commands over single connection.
+type redisClient struct {
+	addr    string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisClient(addr string) *redisClient {
+	return &redisClient{addr: addr, timeout: redisTimeout}
+}
+
+// do sends command and returns reply. 接続が壊れていたら次回つなぎ直す.
+func (c *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, redisDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.rd = conn, bufio.NewReader(conn)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.timeout)
+	}
+	c.conn.SetDeadline(deadline)
+
+	reply, err := c.roundTrip(args)
+	if err != nil && !isRedisReplyError(err) {
+		c.conn.Close()
+		c.conn, c.rd = nil, nil
+	}
+	return reply, err
+}
+
+// isRedisReplyError reports whether err came from server reply. この場合は接続は正常.
+func isRedisReplyError(err error) bool {
+	_, isRedisErr := err.(redisError)
+	return isRedisErr || err == errRedisNil
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	if err := writeRedisCommand(c.conn, args); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.rd)
+}
+
+func writeRedisCommand(w io.Writer, args []string) error {
+	b := make([]byte, 0, 64)
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, '\r', '\n')
+	for _, arg := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, '\r', '\n')
+		b = append(b, arg...)
+		b = append(b, '\r', '\n')
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: short reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// arrayの要素のnilはそのままnilとして返す
+			item, err := readRedisReply(rd)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply %q", line)
+	}
+}
+
+// redisBus is Bus backed by redis PUBLISH/SUBSCRIBE.
+type redisBus struct {
+	client *redisClient
+}
+
+func newRedisBus(client *redisClient) *redisBus {
+	return &redisBus{client: client}
+}
+
+// Publish -
+func (b *redisBus) Publish(ctx context.Context, topic string, payload []byte) error {
+	_, err := b.client.do(ctx, "PUBLISH", topic, string(payload))
+	return err
+}
+
+// Subscribe opens dedicated connection. 購読中の接続では他のcommandを送れないため.
+func (b *redisBus) Subscribe(ctx context.Context, topic string) (<-chan []byte, error) {
+	conn, err := net.DialTimeout("tcp", b.client.addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRedisCommand(conn, []string{"SUBSCRIBE", topic}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rd := bufio.NewReader(conn)
+	// 購読の確認
+	if _, err := readRedisReply(rd); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// 接続が切れて読み込みが終わった場合も、接続を閉じるgoroutineを終わらせる
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan []byte, subscriberBufferSize)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		defer close(ch)
+		defer cancel()
+		for {
+			reply, err := readRedisReply(rd)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Error("redis subscribe", zap.String("topic", topic), zap.Error(err))
+				}
+				return
+			}
+			items, ok := reply.([]interface{})
+			if !ok || len(items) != 3 || items[0] != "message" {
+				continue
+			}
+			payload, _ := items[2].(string)
+			select {
+			case ch <- []byte(payload):
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
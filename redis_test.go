@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redisStandIn is in-process server which speaks subset of RESP used by redisClient/redisBus/redisDirectory.
+// EVALはluaを実行せず、redisDirectoryのscriptと同じ処理をgoで行う. 時刻はadvanceで進める.
+type redisStandIn struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	now     time.Time
+	values  map[string]string
+	expires map[string]time.Time
+	subs    map[string]map[*standInConn]bool
+	conns   map[*standInConn]bool
+}
+
+type standInConn struct {
+	net.Conn
+	mu sync.Mutex // PUBLISHは別の接続のgoroutineから書き込む
+}
+
+func (c *standInConn) reply(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Write(b)
+}
+
+func newRedisStandIn(t *testing.T) *redisStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &redisStandIn{
+		ln:      ln,
+		now:     time.Now(),
+		values:  make(map[string]string),
+		expires: make(map[string]time.Time),
+		subs:    make(map[string]map[*standInConn]bool),
+		conns:   make(map[*standInConn]bool),
+	}
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+func (s *redisStandIn) addr() string { return s.ln.Addr().String() }
+
+func (s *redisStandIn) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &standInConn{Conn: conn}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+// dropConnections closes every client connection. redisとの接続が一時的に切れた状況を作る.
+func (s *redisStandIn) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *redisStandIn) close() {
+	s.ln.Close()
+	s.dropConnections()
+}
+
+func (s *redisStandIn) advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+func (s *redisStandIn) subscribers(topic string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs[topic])
+}
+
+func (s *redisStandIn) handle(c *standInConn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		for _, subs := range s.subs {
+			delete(subs, c)
+		}
+		s.mu.Unlock()
+		c.Close()
+	}()
+	rd := bufio.NewReader(c)
+	for {
+		req, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+		items, _ := req.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			c.reply(respError("empty command"))
+			continue
+		}
+		c.reply(s.exec(c, args))
+	}
+}
+
+func (s *redisStandIn) exec(c *standInConn, args []string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		v, found := s.get(args[1])
+		if !found {
+			return respNil()
+		}
+		return respBulk(v)
+	case "SET":
+		var nx bool
+		var ttl time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				i++
+				ms, _ := strconv.Atoi(args[i])
+				ttl = time.Duration(ms) * time.Millisecond
+			}
+		}
+		if _, found := s.get(args[1]); found && nx {
+			return respNil()
+		}
+		s.set(args[1], args[2], ttl)
+		return []byte("+OK\r\n")
+	case "PUBLISH":
+		var n int
+		for sub := range s.subs[args[1]] {
+			go sub.reply(respArray("message", args[1], args[2]))
+			n++
+		}
+		return respInt(n)
+	case "SUBSCRIBE":
+		if s.subs[args[1]] == nil {
+			s.subs[args[1]] = make(map[*standInConn]bool)
+		}
+		s.subs[args[1]][c] = true
+		return []byte(fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1]))
+	case "EVAL":
+		n, _ := strconv.Atoi(args[2])
+		return s.eval(args[1], args[3:3+n], args[3+n:])
+	default:
+		return respError("unknown command " + args[0])
+	}
+}
+
+// eval emulates scripts of redisDirectory.
+func (s *redisStandIn) eval(script string, keys, argv []string) []byte {
+	ttl := func(ms string) time.Duration {
+		n, _ := strconv.Atoi(ms)
+		return time.Duration(n) * time.Millisecond
+	}
+	switch script {
+	case redisExpireIfOwner:
+		if v, found := s.get(keys[0]); found && v == argv[0] {
+			s.expires[keys[0]] = s.now.Add(ttl(argv[1]))
+			return respInt(1)
+		}
+		return respInt(0)
+	case redisDeleteIfOwner:
+		if v, found := s.get(keys[0]); found && v == argv[0] {
+			delete(s.values, keys[0])
+			delete(s.expires, keys[0])
+			return respInt(1)
+		}
+		return respInt(0)
+	case redisRegister:
+		if _, found := s.get(keys[1]); found {
+			return respInt(0)
+		}
+		s.set(keys[1], argv[1], ttl(argv[2]))
+		s.set(keys[0], argv[0], ttl(argv[2]))
+		return respInt(1)
+	case redisClaim:
+		if owner, found := s.get(keys[0]); found && owner != argv[0] {
+			return respInt(0)
+		}
+		if id, found := s.get(keys[1]); found && id != argv[1] {
+			return respInt(-1)
+		}
+		s.set(keys[0], argv[0], ttl(argv[2]))
+		s.set(keys[1], argv[1], ttl(argv[2]))
+		return respInt(1)
+	default:
+		return respError("unknown script")
+	}
+}
+
+func (s *redisStandIn) get(key string) (string, bool) {
+	if exp, found := s.expires[key]; found && !s.now.Before(exp) {
+		delete(s.values, key)
+		delete(s.expires, key)
+	}
+	v, found := s.values[key]
+	return v, found
+}
+
+func (s *redisStandIn) set(key, value string, ttl time.Duration) {
+	s.values[key] = value
+	delete(s.expires, key)
+	if ttl > 0 {
+		s.expires[key] = s.now.Add(ttl)
+	}
+}
+
+func respNil() []byte             { return []byte("$-1\r\n") }
+func respInt(n int) []byte        { return []byte(":" + strconv.Itoa(n) + "\r\n") }
+func respError(msg string) []byte { return []byte("-ERR " + msg + "\r\n") }
+func respBulk(v string) []byte {
+	return []byte("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+}
+func respArray(items ...string) []byte {
+	b := []byte("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		b = append(b, respBulk(item)...)
+	}
+	return b
+}
+
+func TestRedisClientReplies(t *testing.T) {
+	s := newRedisStandIn(t)
+	c := newRedisClient(s.addr())
+	ctx := context.Background()
+
+	if reply, err := c.do(ctx, "SET", "k", "v"); err != nil || reply != "OK" {
+		t.Fatalf("SET = %v, %v", reply, err)
+	}
+	if reply, err := c.do(ctx, "GET", "k"); err != nil || reply != "v" {
+		t.Fatalf("GET = %v, %v", reply, err)
+	}
+	if _, err := c.do(ctx, "GET", "missing"); err != errRedisNil {
+		t.Fatalf("GET missing = %v", err)
+	}
+	if reply, err := c.do(ctx, "PUBLISH", "topic", "x"); err != nil || reply != int64(0) {
+		t.Fatalf("PUBLISH = %v, %v", reply, err)
+	}
+	// server側のerrorでは接続を使い続ける
+	if _, err := c.do(ctx, "NOPE"); !isRedisReplyError(err) {
+		t.Fatalf("unknown command = %v", err)
+	}
+	if c.conn == nil {
+		t.Fatal("reply error must keep connection")
+	}
+}
+
+func TestRedisClientReconnect(t *testing.T) {
+	s := newRedisStandIn(t)
+	c := newRedisClient(s.addr())
+	ctx := context.Background()
+	if _, err := c.do(ctx, "SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.dropConnections()
+	// 切れた接続で失敗したら、次のcommandでつなぎ直す
+	var reply interface{}
+	var err error
+	for i := 0; i < 2; i++ {
+		if reply, err = c.do(ctx, "GET", "k"); err == nil {
+			break
+		}
+	}
+	if err != nil || reply != "v" {
+		t.Fatalf("GET after reconnect = %v, %v", reply, err)
+	}
+}
+
+// 応答しないredisでも、ctxに期限がなければtimeoutで諦めて次のcommandを通す.
+func TestRedisClientTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := newRedisClient(ln.Addr().String())
+	c.timeout = 50 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.do(context.Background(), "GET", "k")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("stalled command must fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("command without ctx deadline blocks")
+	}
+	if c.conn != nil {
+		t.Fatal("timed out connection must be dropped")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// 間違えた、または回答に時間がかかったquizを、SM-2方式で間隔をのばしながら復習させる.
+// matchや練習の結果から復習cardを作り、復習で回答するたびに次の予定を決め直す.
+
+const (
+	reviewCardKind = "ReviewCard"
+
+	initialEaseFactor = 2.5
+	minEaseFactor     = 1.3
+	// これより遅い正解は覚えきれていないとみなす
+	slowAnswer = 15 * time.Second
+	fastAnswer = 5 * time.Second
+
+	defaultReviewSize = 10
+	maxReviewSize     = 50
+)
+
+// ReviewCard is schedule of a quiz for a user.
+type ReviewCard struct {
+	UserID         string    `json:"user_id"`
+	QuizID         string    `json:"quiz_id"`
+	EaseFactor     float64   `json:"ease_factor" datastore:",noindex"`
+	IntervalDays   int       `json:"interval_days" datastore:",noindex"`
+	Repetitions    int       `json:"repetitions" datastore:",noindex"` // 連続で思い出せた回数
+	Lapses         int       `json:"lapses" datastore:",noindex"`      // 間違えた回数
+	DueAt          time.Time `json:"due_at"`
+	LastReviewedAt time.Time `json:"last_reviewed_at"`
+}
+
+func reviewCardKey(userID, quizID string) *datastore.Key {
+	return datastore.NameKey(reviewCardKind, userID+"|"+quizID, nil)
+}
+
+// answerQuality grades answer in SM-2 scale (0-5).
+// 3未満は思い出せなかったものとして最初からやり直す.
+func answerQuality(correct bool, answerTime time.Duration) int {
+	switch {
+	case !correct:
+		return 1
+	case answerTime >= slowAnswer:
+		return 3
+	case answerTime > 0 && answerTime < fastAnswer:
+		return 5
+	default:
+		return 4
+	}
+}
+
+// schedule updates card by quality of answer at now.
+func (c *ReviewCard) schedule(quality int, now time.Time) {
+	if c.EaseFactor == 0 {
+		c.EaseFactor = initialEaseFactor
+	}
+	if quality < 3 {
+		c.Repetitions = 0
+		c.IntervalDays = 1
+		c.Lapses++
+	} else {
+		c.Repetitions++
+		switch c.Repetitions {
+		case 1:
+			c.IntervalDays = 1
+		case 2:
+			c.IntervalDays = 6
+		default:
+			c.IntervalDays = int(math.Round(float64(c.IntervalDays) * c.EaseFactor))
+		}
+	}
+	q := float64(5 - quality)
+	c.EaseFactor += 0.1 - q*(0.08+q*0.02)
+	if c.EaseFactor < minEaseFactor {
+		c.EaseFactor = minEaseFactor
+	}
+	c.LastReviewedAt = now
+	c.DueAt = now.AddDate(0, 0, c.IntervalDays)
+}
+
+// ReviewQueue -
+type ReviewQueue struct {
+	datastore *datastore.Client
+	logger    *zap.Logger
+	qh        *QuizHandler
+}
+
+// RecordMatch schedules quizzes players got wrong or answered slowly.
+// すでにcardがあるquizは、正解でも回答にあわせて予定を決め直す.
+func (rq *ReviewQueue) RecordMatch(ctx context.Context, res *MatchResult) error {
+	for _, p := range res.Players {
+		for _, s := range p.Submissions {
+			if !s.Submitted || s.QuizID == "" {
+				continue
+			}
+			quality := answerQuality(s.Correct, time.Duration(s.AnswerTimeMS)*time.Millisecond)
+			err := rq.update(ctx, p.User.ID, s.QuizID, func(c *ReviewCard, found bool) bool {
+				if !found && quality >= 4 {
+					return false
+				}
+				c.schedule(quality, s.SubmittedAt)
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// update applies f to card in transaction. fがfalseを返した場合は保存しない.
+func (rq *ReviewQueue) update(ctx context.Context, userID, quizID string, f func(c *ReviewCard, found bool) bool) error {
+	k := reviewCardKey(userID, quizID)
+	_, err := rq.datastore.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var c ReviewCard
+		err := tx.Get(k, &c)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		c.UserID, c.QuizID = userID, quizID
+		if !f(&c, err == nil) {
+			return nil
+		}
+		_, err = tx.Put(k, &c)
+		return err
+	})
+	return err
+}
+
+// due returns cards whose DueAt has come, oldest first.
+func (rq *ReviewQueue) due(ctx context.Context, userID string, now time.Time, limit int) ([]*ReviewCard, error) {
+	var cards []*ReviewCard
+	// index.yamlのUserID, DueAtを使う
+	q := datastore.NewQuery(reviewCardKind).Filter("UserID =", userID).Filter("DueAt <=", now).Order("DueAt").Limit(limit)
+	if _, err := rq.datastore.GetAll(ctx, q, &cards); err != nil {
+		return nil, err
+	}
+	return cards, nil
+}
+
+// reviewItem is due quiz. 正解は含めない.
+type reviewItem struct {
+	Card *ReviewCard `json:"card"`
+	Quiz *QuizView   `json:"quiz"`
+}
+
+// Next returns quizzes due for review. ?limit=で件数を指定できる.
+func (rq *ReviewQueue) Next(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	limit := defaultReviewSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxReviewSize {
+			fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeInvalidRequest, "limit must be 1 to 50")})
+			return
+		}
+		limit = n
+	}
+
+	cards, err := rq.due(r.Context(), user.ID, time.Now(), limit)
+	if err != nil {
+		rq.logger.Error("review due", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	items := make([]*reviewItem, 0, len(cards))
+	for _, c := range cards {
+		quiz, err := rq.qh.FetchFromStorage(r.Context(), c.QuizID)
+		// 削除されたquizは出さない
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			rq.logger.Error("review quiz", zap.Error(err))
+			fail(w, http.StatusInternalServerError, &apiResponse{})
+			return
+		}
+		items = append(items, &reviewItem{Card: c, Quiz: newQuizView(quiz, false)})
+	}
+	(&apiResponse{Data: items}).write(w)
+}
+
+type reviewSubmission struct {
+	QuizID       string `json:"quiz_id"`
+	OptionIdx    int    `json:"option_idx"`
+	AnswerTimeMS int64  `json:"answer_time_ms"` // clientで計測した回答時間. 0なら時間は評価しない
+}
+
+// reviewAnswer is response to review submission. 正解と解説、次の予定を返す.
+type reviewAnswer struct {
+	Correct           bool        `json:"correct"`
+	Quality           int         `json:"quality"`
+	Quiz              *QuizView   `json:"quiz"` // 正解を含む
+	AnswerDescription string      `json:"answer_description_html"`
+	Card              *ReviewCard `json:"card"`
+}
+
+// Submit judges answer to reviewed quiz and reschedules the card.
+func (rq *ReviewQueue) Submit(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	var sub reviewSubmission
+	err := json.NewDecoder(r.Body).Decode(&sub)
+	r.Body.Close()
+	if err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeInvalidRequest, err.Error())})
+		return
+	}
+	if _, err := datastore.DecodeKey(sub.QuizID); err != nil {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeInvalidRequest, "invalid quiz id "+sub.QuizID)})
+		return
+	}
+	quiz, err := rq.qh.FetchFromStorage(r.Context(), sub.QuizID)
+	if err == datastore.ErrNoSuchEntity {
+		fail(w, http.StatusNotFound, &apiResponse{Err: newAPIError(errCodeQuizNotFound, "quiz "+sub.QuizID+" not found")})
+		return
+	}
+	if err != nil {
+		rq.logger.Error("review quiz", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+
+	valid, correct := false, false
+	for _, opt := range quiz.Options {
+		if opt.Index == sub.OptionIdx {
+			valid, correct = true, opt.IsAnswer
+		}
+	}
+	if !valid {
+		fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeInvalidOption, "choose one of the options")})
+		return
+	}
+
+	quality := answerQuality(correct, time.Duration(sub.AnswerTimeMS)*time.Millisecond)
+	var card ReviewCard
+	err = rq.update(r.Context(), user.ID, sub.QuizID, func(c *ReviewCard, found bool) bool {
+		// queueにないquizでも、復習として回答したら以後はscheduleする
+		c.schedule(quality, time.Now())
+		card = *c
+		return true
+	})
+	if err != nil {
+		rq.logger.Error("review schedule", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+
+	description, err := SyntaxHighlight((&Markdown{}).ConvertHTML([]byte(quiz.AnswerDescription)))
+	if err != nil {
+		rq.logger.Error("review answer description", zap.Error(err))
+	}
+	(&apiResponse{Data: &reviewAnswer{
+		Correct:           correct,
+		Quality:           quality,
+		Quiz:              newQuizView(quiz, true),
+		AnswerDescription: string(description),
+		Card:              &card,
+	}}).write(w)
+}
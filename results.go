@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// 終了したmatchの結果. 参加者があとから振り返れるように保存する.
+
+const (
+	matchResultKind    = "MatchResult"
+	defaultHistorySize = 20
+	maxHistorySize     = 100
+
+	resultModeMatch    = "match"
+	resultModePractice = "practice" // 1人で練習した結果. 以前の結果は空なのでmatchとみなす
+	resultModeDaily    = "daily"
+	resultModeAsync    = "async"
+)
+
+// MatchResult -
+type MatchResult struct {
+	MatchID      string          `json:"match_id" datastore:"-"` // keyのname
+	Mode         string          `json:"mode"`
+	Host         string          `json:"host"`
+	Visibility   string          `json:"visibility"`
+	Participants []string        `json:"participants"` // user.ID. historyの検索に使う
+	StartedAt    time.Time       `json:"started_at"`
+	FinishedAt   time.Time       `json:"finished_at"`
+	Quizzes      []*Quiz         `json:"quizzes" datastore:"-"`
+	Players      []*PlayerResult `json:"players" datastore:"-"`
+	Teams        []*TeamResult   `json:"teams,omitempty" datastore:"-"`  // team戦のみ
+	Events       []*MatchEvent   `json:"events,omitempty" datastore:"-"` // hostの操作
+	// datastoreはnestしたsliceを扱えないのでjsonで保存する
+	Detail []byte `json:"-" datastore:",noindex"`
+}
+
+type matchResultDetail struct {
+	Quizzes []*Quiz         `json:"quizzes"`
+	Players []*PlayerResult `json:"players"`
+	Teams   []*TeamResult   `json:"teams,omitempty"`
+	Events  []*MatchEvent   `json:"events,omitempty"`
+}
+
+// PlayerResult is final result of a player. Playersはrank順.
+type PlayerResult struct {
+	User        *User              `json:"user"`
+	Team        string             `json:"team,omitempty"`
+	Score       int                `json:"score"`
+	Rank        int                `json:"rank"` // 同点は同じrank
+	Submissions []SubmissionResult `json:"submissions"`
+}
+
+// SubmissionResult is player's answer to a quiz.
+type SubmissionResult struct {
+	QuizIdx      int       `json:"quiz_idx"`
+	QuizID       string    `json:"quiz_id"`
+	Submitted    bool      `json:"submitted"`
+	OptionIdx    int       `json:"option_idx"`
+	Correct      bool      `json:"correct"`
+	Points       int       `json:"points"`
+	SubmittedAt  time.Time `json:"submitted_at"`
+	AnswerTimeMS int64     `json:"answer_time_ms"`
+}
+
+// result builds MatchResult of finished match. Match.runからのみ呼ぶ.
+func (m *Match) result() *MatchResult {
+	res := &MatchResult{
+		MatchID:    m.id,
+		Mode:       resultModeMatch,
+		Host:       m.host,
+		Visibility: m.config.Visibility,
+		StartedAt:  m.startedAt,
+		FinishedAt: time.Now(),
+		Quizzes:    m.quizzes,
+		Events:     m.events,
+	}
+	for id, ctx := range m.contexts {
+		p := &PlayerResult{User: ctx.User, Team: ctx.Team, Score: ctx.Score()}
+		for i, r := range ctx.Results {
+			s := SubmissionResult{QuizIdx: i, QuizID: m.quizzes[i].ID, Submitted: r.OptionSubmitted}
+			if r.OptionSubmitted {
+				s.OptionIdx, s.Correct, s.Points, s.SubmittedAt = r.OptionIdx, r.Correct, r.Points, r.SubmittedAt
+				s.AnswerTimeMS = int64(r.AnswerTime / time.Millisecond)
+			}
+			p.Submissions = append(p.Submissions, s)
+		}
+		res.Participants = append(res.Participants, id)
+		res.Players = append(res.Players, p)
+	}
+	rankPlayers(res.Players)
+	res.Teams = m.teamResults()
+	return res
+}
+
+func rankPlayers(players []*PlayerResult) {
+	sort.SliceStable(players, func(i, j int) bool {
+		if players[i].Score != players[j].Score {
+			return players[i].Score > players[j].Score
+		}
+		return players[i].User.Name < players[j].User.Name
+	})
+	for i, p := range players {
+		p.Rank = i + 1
+		if i > 0 && players[i-1].Score == p.Score {
+			p.Rank = players[i-1].Rank
+		}
+	}
+}
+
+// saveResult persists result in background. runをblockさせない.
+func (m *Match) saveResult() {
+	if m.store == nil {
+		return
+	}
+	res := m.result()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), matchSaveTimeout)
+		defer cancel()
+		if err := recordResult(ctx, m.store, m.qh, res, m.logger); err != nil {
+			m.logger.Error("save result", zap.Error(err))
+		}
+	}()
+}
+
+// recordResult saves result and reflects it to quiz stats, ratings, profiles and review queue.
+// 保存以外の失敗はlogだけ残す.
+func recordResult(ctx context.Context, store *MatchStore, qh *QuizHandler, res *MatchResult, logger *zap.Logger) error {
+	if err := store.SaveResult(ctx, res); err != nil {
+		return err
+	}
+	if err := qh.RecordStats(ctx, res); err != nil {
+		logger.Error("record stats", zap.Error(err))
+	}
+	if err := qh.RecordRatings(ctx, res); err != nil {
+		logger.Error("record ratings", zap.Error(err))
+	}
+	if err := qh.users.RecordMatch(ctx, res); err != nil {
+		logger.Error("record match", zap.Error(err))
+	}
+	if err := qh.reviews.RecordMatch(ctx, res); err != nil {
+		logger.Error("record reviews", zap.Error(err))
+	}
+	return nil
+}
+
+// SaveResult -
+func (s *MatchStore) SaveResult(ctx context.Context, res *MatchResult) error {
+	detail, err := json.Marshal(&matchResultDetail{Quizzes: res.Quizzes, Players: res.Players, Teams: res.Teams, Events: res.Events})
+	if err != nil {
+		return err
+	}
+	res.Detail = detail
+	_, err = s.datastore.Put(ctx, datastore.NameKey(matchResultKind, res.MatchID, nil), res)
+	return err
+}
+
+// FetchResult -
+func (s *MatchStore) FetchResult(ctx context.Context, matchID string) (*MatchResult, error) {
+	var res MatchResult
+	if err := s.datastore.Get(ctx, datastore.NameKey(matchResultKind, matchID, nil), &res); err != nil {
+		return nil, err
+	}
+	res.MatchID = matchID
+	return &res, res.decodeDetail()
+}
+
+// History returns results of matches the user played, newest first.
+func (s *MatchStore) History(ctx context.Context, userID string, limit int) ([]*MatchResult, error) {
+	var results []*MatchResult
+	// index.yamlのParticipants, -FinishedAtを使う
+	q := datastore.NewQuery(matchResultKind).Filter("Participants =", userID).Order("-FinishedAt").Limit(limit)
+	keys, err := s.datastore.GetAll(ctx, q, &results)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		results[i].MatchID = k.Name
+		if err := results[i].decodeDetail(); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func (res *MatchResult) decodeDetail() error {
+	var detail matchResultDetail
+	if err := json.Unmarshal(res.Detail, &detail); err != nil {
+		return err
+	}
+	res.Quizzes, res.Players, res.Teams, res.Events = detail.Quizzes, detail.Players, detail.Teams, detail.Events
+	return nil
+}
+
+func (res *MatchResult) player(userID string) *PlayerResult {
+	for _, p := range res.Players {
+		if p.User.ID == userID {
+			return p
+		}
+	}
+	return nil
+}
+
+// canView reports whether user can see result. privateなmatchは参加者とhostだけ.
+func (res *MatchResult) canView(user *User) bool {
+	if res.Visibility != visibilityPrivate {
+		return true
+	}
+	return user.ID == res.Host || res.player(user.ID) != nil
+}
+
+// matchSummary is entry of user's history.
+type matchSummary struct {
+	MatchID    string    `json:"match_id"`
+	Mode       string    `json:"mode"`
+	Host       string    `json:"host"`
+	FinishedAt time.Time `json:"finished_at"`
+	QuizNum    int       `json:"quiz_num"`
+	PlayerNum  int       `json:"player_num"`
+	Score      int       `json:"score"`
+	Rank       int       `json:"rank"`
+	ReviewURL  string    `json:"review_url"`
+}
+
+// MatchHistory returns matches the user played. ?limit=で件数を指定できる.
+func (mg *MatchGroup) MatchHistory(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	limit := defaultHistorySize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxHistorySize {
+			fail(w, http.StatusBadRequest, &apiResponse{Err: newAPIError(errCodeInvalidRequest, "limit must be 1 to 100")})
+			return
+		}
+		limit = n
+	}
+
+	results, err := mg.store.History(r.Context(), user.ID, limit)
+	if err != nil {
+		mg.logger.Error("history", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	summaries := make([]*matchSummary, 0, len(results))
+	for _, res := range results {
+		s := &matchSummary{
+			MatchID:    res.MatchID,
+			Mode:       res.Mode,
+			Host:       res.Host,
+			FinishedAt: res.FinishedAt,
+			QuizNum:    len(res.Quizzes),
+			PlayerNum:  len(res.Players),
+			ReviewURL:  "/match/" + res.MatchID + "/review",
+		}
+		if s.Mode == "" {
+			s.Mode = resultModeMatch
+		}
+		if p := res.player(user.ID); p != nil {
+			s.Score, s.Rank = p.Score, p.Rank
+		}
+		summaries = append(summaries, s)
+	}
+	(&apiResponse{Data: summaries}).write(w)
+}
+
+// MatchResults returns whole result of finished match.
+func (mg *MatchGroup) MatchResults(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		unauthorized(w)
+		return
+	}
+	res, err := mg.store.FetchResult(r.Context(), params.ByName("id"))
+	if err == datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		mg.logger.Error("result", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	// 存在を知られないように404にする
+	if !res.canView(user) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	(&apiResponse{Data: res}).write(w)
+}
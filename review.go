@@ -0,0 +1,122 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"cloud.google.com/go/datastore"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// 終了したmatchの振り返りページ. 保存したMatchResultから描画するので、どのreplicaでも表示できる.
+
+type reviewPage struct {
+	MatchID   string
+	Players   []*PlayerResult
+	Questions []*questionReview
+}
+
+type questionReview struct {
+	Number            int // 1始まり
+	DescriptionHTML   template.HTML
+	AnswerDescription template.HTML
+	Options           []*optionReview
+	Answers           []*answerReview // Playersと同じ順
+	SubmittedNum      int
+	CorrectNum        int
+	CorrectRate       int // 回答したplayerのうち正解した割合(%)
+}
+
+type optionReview struct {
+	Number      int // 1始まり
+	Description string
+	IsAnswer    bool
+	Count       int
+}
+
+type answerReview struct {
+	User      *User
+	Submitted bool
+	OptionNum int // 1始まり. 選んだoptionがquizにない場合は0
+	Correct   bool
+	Points    int
+}
+
+func newReviewPage(res *MatchResult) (*reviewPage, error) {
+	page := &reviewPage{MatchID: res.MatchID, Players: res.Players}
+	converter := &Markdown{}
+	for i, quiz := range res.Quizzes {
+		answerHTML, err := SyntaxHighlight(converter.ConvertHTML([]byte(quiz.AnswerDescription)))
+		if err != nil {
+			return nil, err
+		}
+		q := &questionReview{
+			Number: i + 1,
+			// 保存時にserverでmarkdownから変換したもの
+			DescriptionHTML:   template.HTML(quiz.DescriptionHTML),
+			AnswerDescription: template.HTML(answerHTML),
+		}
+		// 回答はoptionのIndexで保存しているので、表示する位置に変換する
+		position := make(map[int]int, len(quiz.Options))
+		for j, o := range quiz.Options {
+			position[o.Index] = j
+			q.Options = append(q.Options, &optionReview{Number: j + 1, Description: o.Description, IsAnswer: o.IsAnswer})
+		}
+		for _, p := range res.Players {
+			a := &answerReview{User: p.User}
+			if i < len(p.Submissions) && p.Submissions[i].Submitted {
+				s := p.Submissions[i]
+				a.Submitted, a.Correct, a.Points = true, s.Correct, s.Points
+				q.SubmittedNum++
+				if s.Correct {
+					q.CorrectNum++
+				}
+				// quizにないoptionへの回答は数えない
+				if j, found := position[s.OptionIdx]; found {
+					a.OptionNum = q.Options[j].Number
+					q.Options[j].Count++
+				}
+			}
+			q.Answers = append(q.Answers, a)
+		}
+		if q.SubmittedNum > 0 {
+			q.CorrectRate = q.CorrectNum * 100 / q.SubmittedNum
+		}
+		page.Questions = append(page.Questions, q)
+	}
+	return page, nil
+}
+
+// RenderReview renders every question with answers and stats of finished match.
+func (mg *MatchGroup) RenderReview(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, found := UserFromReq(r)
+	if !found {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	res, err := mg.store.FetchResult(r.Context(), params.ByName("id"))
+	if err == datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		mg.logger.Error("result", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !res.canView(user) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	page, err := newReviewPage(res)
+	if err != nil {
+		mg.logger.Error("review", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := mg.ts.ExecuteTemplate(w, "review", page); err != nil {
+		mg.logger.Error("render review", zap.Error(err))
+	}
+}
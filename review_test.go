@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+// optionのIndexが並び順と違っても、選んだoptionで数える.
+func TestReviewCountsByOptionIndex(t *testing.T) {
+	res := &MatchResult{
+		Quizzes: []*Quiz{{ID: "q0", Options: []*Option{{Index: 2, IsAnswer: true}, {Index: 0}, {Index: 1}}}},
+		Players: []*PlayerResult{
+			{User: &User{ID: "a"}, Submissions: []SubmissionResult{{Submitted: true, OptionIdx: 2, Correct: true}}},
+			{User: &User{ID: "b"}, Submissions: []SubmissionResult{{Submitted: true, OptionIdx: 0}}},
+			{User: &User{ID: "c"}, Submissions: []SubmissionResult{{Submitted: true, OptionIdx: 5}}},
+		},
+	}
+	page, err := newReviewPage(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := page.Questions[0]
+	for i, want := range []int{1, 1, 0} {
+		if q.Options[i].Count != want {
+			t.Fatalf("option %d count = %d, want %d", i, q.Options[i].Count, want)
+		}
+	}
+	for i, want := range []int{1, 2, 0} {
+		if q.Answers[i].OptionNum != want {
+			t.Fatalf("answer %d option = %d, want %d", i, q.Answers[i].OptionNum, want)
+		}
+	}
+	if q.SubmittedNum != 3 || q.CorrectNum != 1 {
+		t.Fatalf("submitted %d, correct %d", q.SubmittedNum, q.CorrectNum)
+	}
+}
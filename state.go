@@ -1,130 +1,227 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"sort"
-	ttemplate "text/template"
-
-	"github.com/davecgh/go-spew/spew"
-	"go.uber.org/zap"
+	"time"
 )
 
 // State -
 type State struct {
-	Users    []*User
+	Users    []*User // 接続中のuser
 	Quiz     *Quiz
 	QuizIdx  int
 	Config   *MatchConfig
 	Contexts map[string]*Context
 	match    *Match
+
+	// 誰に送るstateか
+	viewer *User
+	role   string
 }
 
-// StateView -
+const (
+	phaseWaiting  = "waiting"  // 開始前
+	phaseQuestion = "question" // 出題中
+	phaseFinished = "finished"
+)
+
+// 各問題に対するplayerの回答状況
+const (
+	resultUnanswered = "unanswered"
+	resultAnswered   = "answered" // 正誤はまだ見せられない
+	resultCorrect    = "correct"
+	resultWrong      = "wrong"
+)
+
+// StateView is payload of state message. clientはこれだけで画面を組み立てる.
 type StateView struct {
-	*State    `json:"-"`
-	UsersView string `json:"users_view"`
-	QuizIdx   int    `json:"quiz_idx"`
-	QuizView  string `json:"quiz_view"`
+	Role     string                 `json:"role"`
+	Phase    string                 `json:"phase"`
+	JoinCode string                 `json:"join_code"`
+	QuizIdx  int                    `json:"quiz_idx"`
+	QuizNum  int                    `json:"quiz_num"`
+	Deadline *time.Time             `json:"deadline,omitempty"`
+	Paused   bool                   `json:"paused,omitempty"` // 一時停止中はdeadlineを送らない
+	Quiz     *QuizView              `json:"quiz"`
+	Players  map[string]*PlayerView `json:"players"`         // keyはuser.ID. 差分を小さくするためmapにしている
+	Teams    []*TeamView            `json:"teams,omitempty"` // team戦のみ. rank順
+
+	// 以下はpresenterのみ
+	AnswerCount *AnswerCountView `json:"answer_count,omitempty"`
+	Reveal      *RevealView      `json:"reveal,omitempty"`
+	Leaderboard []*RankView      `json:"leaderboard,omitempty"`
+}
+
+// QuizView is quiz without answer flags.
+type QuizView struct {
+	ID              string        `json:"id"`
+	Author          *User         `json:"author"`
+	DescriptionHTML string        `json:"description_html"`
+	Options         []*OptionView `json:"options"`
+	AnswerIdx       *int          `json:"answer_idx,omitempty"` // 正解発表後のみ
+}
+
+// OptionView -
+type OptionView struct {
+	Index       int    `json:"index"`
+	Description string `json:"description"`
+}
+
+// PlayerView -
+type PlayerView struct {
+	User      *User  `json:"user"`
+	Team      string `json:"team,omitempty"`
+	Captain   bool   `json:"captain,omitempty"`
+	Score     int    `json:"score"`
+	Ready     bool   `json:"ready"`
+	Connected bool   `json:"connected"`
+	// 切断されたplayerも一覧には残す
+	DisconnectedAt *time.Time    `json:"disconnected_at,omitempty"`
+	Submitted      bool          `json:"submitted"` // 出題中のquizに回答済みか
+	Results        []*ResultView `json:"results"`
+}
+
+// ResultView -
+type ResultView struct {
+	Status    string `json:"status"`
+	OptionIdx *int   `json:"option_idx,omitempty"`
+}
+
+func (s *State) phase() string {
+	switch s.match.status {
+	case starting:
+		return phaseQuestion
+	case finished:
+		return phaseFinished
+	default:
+		return phaseWaiting
+	}
+}
+
+func (s *State) quiz() *QuizView {
+	if s.Quiz == nil {
+		return nil
+	}
+	return newQuizView(s.Quiz, s.match.quizeAnswerVisibilities[s.QuizIdx])
 }
 
-func (v *StateView) users() string {
-	var b bytes.Buffer
-	b.WriteString(`
-<table>
-	<thead>
-		<tr>
-			<th>User</th>`)
-	n := v.State.Config.QuizNum
-	for i := 1; i <= n; i++ {
-		b.WriteString(fmt.Sprintf("<th>%d</th>", i))
+// newQuizView converts quiz. revealの場合のみ正解を含める.
+func newQuizView(quiz *Quiz, reveal bool) *QuizView {
+	v := &QuizView{
+		ID:              quiz.ID,
+		Author:          quiz.User,
+		DescriptionHTML: quiz.DescriptionHTML,
 	}
-	b.WriteString(`</tr></thead><tbody>`)
+	for _, opt := range quiz.Options {
+		v.Options = append(v.Options, &OptionView{Index: opt.Index, Description: opt.Description})
+		if opt.IsAnswer && reveal {
+			idx := opt.Index
+			v.AnswerIdx = &idx
+		}
+	}
+	return v
+}
 
-	for _, user := range v.Users {
-		ctx, found := v.Contexts[user.Name]
-		if !found {
-			continue
+func (s *State) players() map[string]*PlayerView {
+	connected := make(map[string]bool, len(s.Users))
+	for _, u := range s.Users {
+		connected[u.ID] = true
+	}
+
+	players := make(map[string]*PlayerView, len(s.Contexts))
+	for id, ctx := range s.Contexts {
+		p := &PlayerView{
+			User:      ctx.User,
+			Team:      ctx.Team,
+			Captain:   ctx.Captain,
+			Ready:     ctx.Ready,
+			Connected: connected[id],
 		}
-		spew.Dump(ctx)
-		b.WriteString(fmt.Sprintf(`<tr><td><img class="avatar" src="%s" alt="%s"></td>`, user.AvatarURL, user.Name))
-		for _, qr := range ctx.Results {
-			if !qr.OptionSubmitted {
-				b.WriteString(`<td>?</td>`)
-				continue
+		if !ctx.DisconnectedAt.IsZero() && !p.Connected {
+			disconnectedAt := ctx.DisconnectedAt
+			p.DisconnectedAt = &disconnectedAt
+		}
+		for i, qr := range ctx.Results {
+			hidden := !s.canSeeChoice(id, i)
+			revealed := s.match.resultRevealed(i)
+			p.Results = append(p.Results, resultView(qr, hidden, revealed))
+			// 点数から正誤がわかってしまうので、見せられる結果の分だけ加算する
+			if !hidden && qr.OptionSubmitted && revealed {
+				p.Score += qr.Points
 			}
-			// optionidx 0 => 選択肢1なので
-			optionNum := qr.OptionIdx + 1
-			if *qr.UserCanGetTheirResult {
-				class := "wrong"
-				if qr.Correct {
-					class = "correct"
-				}
-				b.WriteString(fmt.Sprintf(`<td class="%s">%d</td>`, class, optionNum))
-			} else {
-				b.WriteString(fmt.Sprintf("<td>%d</td>", optionNum))
+			if i == s.QuizIdx && qr.OptionSubmitted {
+				p.Submitted = true
 			}
 		}
-		b.WriteString(`</tr>`)
+		players[id] = p
 	}
-	b.WriteString(`</tbody></table>`)
-
-	return b.String()
+	return players
 }
 
-// htmlそのまま書くので、escapeしないために、text templateを利用する
-var quizDivTmpl = ttemplate.Must(ttemplate.New("quiz").Funcs(ttemplate.FuncMap{}).Parse(`
-<div class="quiz-data">
-	<div class="quiz-creater">
-		<span>出題者</span>
-		<img class="avatar" src="{{ .Quiz.User.AvatarURL }}" alt="{{ .Quiz.User.Name}}">
-	</div>
-	<div class="quiz-content">
-		{{ .Quiz.DescriptionHTML }}
-	</div>
-	<div class="quiz-options">
-	{{ range .Quiz.Options }}
-	  <div class="quiz-option">
-		  <input type="radio" name="option-index-radio" value="{{ .Index }}">
-		  <div class="quiz-option-description">{{ .Description }}</div>
-	  </div>
-	{{ end }}
-	</div>
-	<button type="button" id="quiz-submit-btn">Submit</button>
-</div>
-`))
-
-func (v *StateView) quiz() string {
-	if v.Quiz == nil {
-		return ""
+// canSeeChoice reports whether viewer can see what player chose for the quiz.
+// 締め切り前に他のplayerの回答が見えるとコピーできてしまう.
+func (s *State) canSeeChoice(player string, quizIdx int) bool {
+	if player == s.viewer.ID || s.match.isClosed(quizIdx) {
+		return true
 	}
-	var b bytes.Buffer
-	if err := quizDivTmpl.Execute(&b, v); err != nil {
-		v.State.match.logger.Error("template_execute", zap.Error(err))
-		return ""
+	// 合意modeでは相談できるようにteam内の回答は見せる
+	if s.Config.TeamMode == teamModeConsensus && s.match.sameTeam(player, s.viewer.ID) {
+		return true
+	}
+	switch s.role {
+	case viewerHost:
+		return s.Config.HostAnswerView == answerViewChoices
+	case viewerSpectator:
+		return s.Config.SpectatorAnswerView == answerViewChoices
+	default:
+		return false
 	}
-	return b.String()
 }
 
-func (v *StateView) encode() []byte {
-	// userの一覧が並び替わると嫌なのでsortしておく
-	sort.Slice(v.Users, func(i, j int) bool {
-		return v.Users[i].Name < v.Users[j].Name
-	})
-
-	v.QuizView = v.quiz()
-	v.UsersView = v.users()
-	v.QuizIdx = v.State.QuizIdx
+// resultView converts result. hiddenの場合は回答済みかどうかだけ見せる.
+// revealedでなければ正誤は見せない.
+func resultView(qr QuizResult, hidden, revealed bool) *ResultView {
+	if !qr.OptionSubmitted {
+		return &ResultView{Status: resultUnanswered}
+	}
+	if hidden {
+		return &ResultView{Status: resultAnswered}
+	}
+	// optionidx 0 => 選択肢1なのでclient側で+1する
+	optionIdx := qr.OptionIdx
+	v := &ResultView{Status: resultAnswered, OptionIdx: &optionIdx}
+	if revealed {
+		v.Status = resultWrong
+		if qr.Correct {
+			v.Status = resultCorrect
+		}
+	}
+	return v
+}
 
-	encoded, err := json.Marshal(v)
-	if err != nil {
-		v.State.match.logger.Error("mashal fail", zap.Error(err))
-		return []byte{}
+func (s *State) view() *StateView {
+	v := &StateView{
+		Role:     s.role,
+		Phase:    s.phase(),
+		JoinCode: s.match.code,
+		QuizIdx:  s.QuizIdx,
+		QuizNum:  len(s.match.quizzes),
+		Quiz:     s.quiz(),
+		Players:  s.players(),
+	}
+	v.Teams = s.teams(v.Players)
+	if s.role == viewerPresenter {
+		s.presenterView(v)
+	}
+	v.Paused = s.match.paused()
+	if deadline := s.match.deadline(); !deadline.IsZero() && v.Phase == phaseQuestion && !v.Paused {
+		v.Deadline = &deadline
 	}
-	return encoded
+	return v
 }
 
-func (s *State) encode() []byte {
-	return (&StateView{State: s}).encode()
+// viewFor returns state projected for viewer.
+func (s *State) viewFor(viewer *User, role string) *StateView {
+	s.viewer = viewer
+	s.role = role
+	return s.view()
 }
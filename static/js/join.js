@@ -0,0 +1,58 @@
+class Join {
+    constructor() {
+        this.dom = {}
+        this.dom.code = document.getElementById('join-code')
+        this.dom.passcode = document.getElementById('join-passcode')
+        this.dom.error = document.getElementById('join-error')
+
+        this.id_token = query('id_token')
+        this.join = this.join.bind(this)
+
+        document.getElementById('join-btn').addEventListener('click', this.join, false)
+    }
+
+    join() {
+        fetch('/api/v1/join', {
+            method: 'POST',
+            headers: { 'Authorization': this.id_token },
+            body: JSON.stringify({
+                code: this.dom.code.value,
+                passcode: this.dom.passcode.value,
+            })
+        })
+        .then(res => {
+            if (res.ok) {
+                res.json().then(res => {
+                    window.location.href = res.data.url + "?id_token=" + this.id_token
+                })
+                return
+            }
+            switch (res.status) {
+            case 403:
+                // passcodeが必要なmatch
+                this.dom.passcode.classList.remove('hidden')
+                this.dom.error.textContent = 'パスコードが違います'
+                break
+            case 404:
+                this.dom.error.textContent = '参加コードが見つかりません'
+                break
+            default:
+                this.dom.error.textContent = '参加できませんでした'
+            }
+        })
+    }
+}
+
+const query = key => {
+    let found = ""
+    window.location.search.substr(1).split('&').map(kv => kv.split('=')).forEach(kv => {if (kv[0] === key) { found = kv[1] }})
+    return found
+}
+
+let gJoin
+
+const init = () => {
+    gJoin = new Join()
+}
+
+window.addEventListener('load', init)
@@ -1,56 +1,376 @@
 let currentMsg
 
+const errorMessages = {
+    "invalid_option": "選択肢を選んでください",
+    "quiz_closed": "この問題の回答は締め切られました",
+    "already_submitted": "回答済みです",
+    "not_participant": "matchに参加していません",
+    "match_full": "matchが満員です",
+    "not_host": "hostだけが操作できます",
+    "match_paused": "一時停止中です",
+    "invalid_state": "今はこの操作はできません",
+    "kicked": "hostによってmatchから外されました",
+    "banned": "このmatchには参加できません",
+}
+
 class Match {
-    constructor(conn) {
+    constructor() {
         this.dom = {}
         this.dom.status = document.getElementById('status')
         this.dom.quiz = document.getElementById('quiz')
+        this.dom.joinCode = document.getElementById('join-code')
+        this.dom.phase = document.getElementById('phase')
+        this.dom.countdown = document.getElementById('countdown')
+        this.dom.hostControls = document.getElementById('host-controls')
+        this.dom.readyBtn = document.getElementById('ready-btn')
+        this.dom.chatLog = document.getElementById('chat-log')
+        this.dom.chatInput = document.getElementById('chat-input')
+        this.dom.connection = document.getElementById('connection')
+        this.dom.reviewLink = document.getElementById('review-link')
 
         this.id_token = query('id_token')
+        this.conn = null
+        this.backoff = new Backoff()
+        // kick/banされたら再接続しない
+        this.removed = false
+        // playerとして参加したhostもroleはplayerになるのでjoinのackで覚えておく
+        this.isHost = false
+        // 同じmatchに戻るためのtoken. reloadしても使えるようにsessionStorageに置く
+        this.resumeKey = 'resume:' + window.location.pathname
         // userの回答状況
         this.userStatus = "initial"
         this.quizIdx = -1
+        this.ready = false
+        // serverから受け取ったstateとそのversion
+        this.state = null
+        this.version = -1
 
+        // ackを待っているrequest. keyはrequest_id
+        this.requestSeq = 0
+        this.pending = {}
+
+        this.onopen = this.onopen.bind(this)
         this.onmessage = this.onmessage.bind(this)
         this.onclose = this.onclose.bind(this)
         this.onsubmit = this.onsubmit.bind(this)
+        this.onready = this.onready.bind(this)
+        this.onchat = this.onchat.bind(this)
+
+        this.dom.readyBtn.addEventListener('click', this.onready)
+        this.dom.chatInput.addEventListener('keydown', this.onchat)
+        for (const btn of document.querySelectorAll('[data-host-action]')) {
+            btn.addEventListener('click', () => this.control(btn.dataset.hostAction))
+        }
+    }
 
+    connect() {
+        const conn = new WebSocket(wsEndpoint())
+        conn.onopen = this.onopen
         conn.onmessage = this.onmessage
         conn.onclose = this.onclose
+        this.conn = conn
+        gConn = conn
     }
 
-    updateUserState(usersTable) {
+    // request sends typed message and resolves when server acks it.
+    request(type, payload) {
+        const requestID = String(++this.requestSeq)
+        return new Promise((resolve, reject) => {
+            this.pending[requestID] = { resolve, reject }
+            this.conn.send(JSON.stringify({
+                v: PROTOCOL_VERSION,
+                type: type,
+                request_id: requestID,
+                payload: payload,
+            }))
+        })
+    }
+    settle(msg) {
+        const p = this.pending[msg.request_id]
+        if (!p) {
+            console.log("unexpected", msg)
+            return
+        }
+        delete this.pending[msg.request_id]
+        if (msg.type === 'ack') {
+            p.resolve(msg.payload)
+        } else {
+            p.reject(msg.payload)
+        }
+    }
+
+    updateUserState(players, quizNum, isHost) {
+        const table = document.createElement('table')
+        const head = table.createTHead().insertRow()
+        head.appendChild(th('User'))
+        for (let i = 1; i <= quizNum; i++) {
+            head.appendChild(th(String(i)))
+        }
+        head.appendChild(th('Score'))
+
+        const body = table.createTBody()
+        // userの一覧が並び替わると嫌なのでsortしておく
+        const sorted = Object.values(players).sort((a, b) => a.user.name < b.user.name ? -1 : 1)
+        for (const p of sorted) {
+            const row = body.insertRow()
+            const userCell = row.insertCell()
+            const avatar = document.createElement('img')
+            avatar.className = 'avatar'
+            avatar.src = p.user.avatar_url
+            avatar.alt = p.user.name
+            avatar.title = p.user.name
+            avatar.classList.toggle('disconnected', !p.connected)
+            userCell.appendChild(avatar)
+            if (p.ready) {
+                userCell.classList.add('ready')
+            }
+            for (const r of p.results) {
+                const cell = row.insertCell()
+                // optionidx 0 => 選択肢1なので
+                cell.textContent = r.option_idx === undefined ? '?' : String(r.option_idx + 1)
+                if (r.status === 'correct' || r.status === 'wrong') {
+                    cell.className = r.status
+                }
+            }
+            row.insertCell().textContent = String(p.score)
+            if (isHost) {
+                const cell = row.insertCell()
+                for (const action of ['kick', 'ban']) {
+                    const btn = document.createElement('button')
+                    btn.type = 'button'
+                    btn.textContent = action === 'kick' ? 'Kick' : 'Ban'
+                    btn.addEventListener('click', () => this.control(action, p.user.id))
+                    cell.appendChild(btn)
+                }
+            }
+        }
+
         this.dom.status.innerHTML = ''
-        this.dom.status.innerHTML = usersTable
+        this.dom.status.appendChild(table)
     }
-    updateQuiz(quiz) {
-        // 制御必要
-        this.dom.quiz.innerHTML = ''
-        this.dom.quiz.innerHTML = quiz
+    updateQuiz(quiz, quizIdx) {
+        if (!quiz) {
+            this.dom.quiz.innerHTML = ''
+            return
+        }
+        // 同じ問題の間は選択状態を保つため作り直さない
+        if (quizIdx !== this.quizIdx) {
+            this.dom.quiz.innerHTML = ''
+            this.dom.quiz.appendChild(this.renderQuiz(quiz))
+        }
+        if (quiz.answer_idx !== undefined) {
+            for (const opt of this.dom.quiz.querySelectorAll('.quiz-option')) {
+                opt.classList.toggle('answer', Number(opt.dataset.index) === quiz.answer_idx)
+            }
+        }
     }
-    // submit buttonも毎回serverからinjectされるので、eventの設定が必要
-    handleSubmit() {
-        const submitBtn = document.getElementById('quiz-submit-btn')
-        if (submitBtn) {
-            submitBtn.addEventListener('click', this.onsubmit)
+    renderQuiz(quiz) {
+        const div = document.createElement('div')
+        div.className = 'quiz-data'
+
+        const creater = document.createElement('div')
+        creater.className = 'quiz-creater'
+        const label = document.createElement('span')
+        label.textContent = '出題者'
+        const avatar = document.createElement('img')
+        avatar.className = 'avatar'
+        avatar.src = quiz.author.avatar_url
+        avatar.alt = quiz.author.name
+        creater.appendChild(label)
+        creater.appendChild(avatar)
+        div.appendChild(creater)
+
+        // markdownからserverで変換済みのhtml
+        const content = document.createElement('div')
+        content.className = 'quiz-content'
+        content.innerHTML = quiz.description_html
+        div.appendChild(content)
+
+        const options = document.createElement('div')
+        options.className = 'quiz-options'
+        for (const opt of quiz.options) {
+            const option = document.createElement('div')
+            option.className = 'quiz-option'
+            option.dataset.index = opt.index
+            const radio = document.createElement('input')
+            radio.type = 'radio'
+            radio.name = 'option-index-radio'
+            radio.value = opt.index
+            const description = document.createElement('div')
+            description.className = 'quiz-option-description'
+            description.textContent = opt.description
+            option.appendChild(radio)
+            option.appendChild(description)
+            options.appendChild(option)
+        }
+        div.appendChild(options)
+
+        const submitBtn = document.createElement('button')
+        submitBtn.type = 'button'
+        submitBtn.id = 'quiz-submit-btn'
+        submitBtn.textContent = 'Submit'
+        submitBtn.addEventListener('click', this.onsubmit)
+        div.appendChild(submitBtn)
+
+        const submitError = document.createElement('div')
+        submitError.className = 'quiz-submit-error'
+        submitError.id = 'quiz-submit-error'
+        div.appendChild(submitError)
+
+        return div
+    }
+    updatePhase(state) {
+        const labels = {
+            "waiting": "開始を待っています",
+            "question": `${state.quiz_idx + 1} / ${state.quiz_num}`,
+            "finished": "終了しました",
+        }
+        this.dom.phase.textContent = (labels[state.phase] || state.phase) + (state.paused ? ' (一時停止中)' : '')
+        // 終了したら振り返りページへ. id_tokenを引き継ぐためqueryはそのまま
+        if (state.phase === 'finished') {
+            this.dom.reviewLink.href = window.location.pathname + '/review' + window.location.search
+            this.dom.reviewLink.classList.remove('hidden')
+        }
+
+        clearInterval(this.countdown)
+        this.dom.countdown.textContent = ''
+        if (state.deadline) {
+            const deadline = new Date(state.deadline)
+            const tick = () => {
+                const remaining = Math.max(0, Math.ceil((deadline - Date.now()) / 1000))
+                this.dom.countdown.textContent = `残り${remaining}秒`
+            }
+            tick()
+            this.countdown = setInterval(tick, 500)
         }
     }
 
     updateState(state) {
-        this.updateUserState(state.users_view)
-        this.updateQuiz(state.quiz_view)
+        // spectatorは回答できない
+        document.body.classList.toggle('spectator', state.role !== 'player')
+        if (state.role === 'host') {
+            this.isHost = true
+            this.dom.hostControls.classList.remove('hidden')
+        }
+        this.updateUserState(state.players, state.quiz_num, this.isHost)
+        this.updateQuiz(state.quiz, state.quiz_idx)
+        this.updatePhase(state)
         this.quizIdx = state.quiz_idx
-        this.handleSubmit()
+        this.dom.joinCode.textContent = state.join_code
+    }
+
+    appendChat(chat) {
+        const line = document.createElement('div')
+        line.className = 'chat-line'
+        const name = document.createElement('span')
+        name.className = 'chat-user'
+        name.textContent = chat.user.name
+        const text = document.createElement('span')
+        text.textContent = chat.text
+        line.appendChild(name)
+        line.appendChild(text)
+        this.dom.chatLog.appendChild(line)
+        this.dom.chatLog.scrollTop = this.dom.chatLog.scrollHeight
     }
 
+    onopen(event) {
+        this.backoff.reset()
+        this.setConnectionStatus(true)
+        // ?spectate=1 の場合はplayerとして参加せずに観戦する
+        if (query('spectate') === '') {
+            this.resumeOrJoin()
+        }
+        this.heartbeat = setInterval(() => this.request('heartbeat').catch(err => console.log("heartbeat", err)), HEARTBEAT_INTERVAL)
+    }
+    resumeOrJoin() {
+        const token = sessionStorage.getItem(this.resumeKey)
+        if (!token) {
+            this.join()
+            return
+        }
+        this.request('resume', { token: token })
+            .then(ack => this.onjoined(ack))
+            .catch(err => {
+                console.log("resume", err)
+                sessionStorage.removeItem(this.resumeKey)
+                this.join()
+            })
+    }
+    join() {
+        this.request('join')
+            .then(ack => this.onjoined(ack))
+            .catch(err => this.showError(err))
+    }
+    onjoined(ack) {
+        sessionStorage.setItem(this.resumeKey, ack.resume_token)
+        if (ack.host) {
+            this.isHost = true
+            this.dom.hostControls.classList.remove('hidden')
+        }
+    }
     onmessage(event) {
-        const state = JSON.parse(event.data)
-        console.log("msg", state)
-        currentMsg = state
-        this.updateState(state)
+        const msg = JSON.parse(event.data)
+        console.log("msg", msg)
+        currentMsg = msg
+        switch (msg.type) {
+        case 'state':
+            this.state = msg.payload.state
+            this.version = msg.payload.version
+            this.updateState(this.state)
+            break
+        case 'patch':
+            // 途中のpatchを取りこぼしていたら全体を取り直す
+            if (msg.payload.base !== this.version) {
+                this.request('sync').catch(err => console.log("sync", err))
+                break
+            }
+            this.state = applyMergePatch(this.state, msg.payload.patch)
+            this.version = msg.payload.version
+            this.updateState(this.state)
+            break
+        case 'chat':
+            this.appendChat(msg.payload)
+            break
+        case 'ack':
+        case 'error':
+            // request_idのないerrorはserverから一方的に送られたもの
+            if (msg.type === 'error' && !msg.request_id) {
+                this.onremoved(msg.payload)
+                break
+            }
+            this.settle(msg)
+            break
+        default:
+            console.log("unknown message", msg)
+        }
+    }
+    onremoved(err) {
+        if (err.code !== 'kicked' && err.code !== 'banned') {
+            console.log("error", err)
+            return
+        }
+        this.removed = true
+        sessionStorage.removeItem(this.resumeKey)
+        this.showError(err)
     }
     onclose(event) {
         console.log("close", event)
+        clearInterval(this.heartbeat)
+        this.setConnectionStatus(false)
+        // 返ってこないackは諦める
+        for (const p of Object.values(this.pending)) {
+            p.reject({ code: "disconnected" })
+        }
+        this.pending = {}
+        if (this.removed) {
+            this.dom.connection.textContent = '切断されました'
+            return
+        }
+
+        setTimeout(() => this.connect(), this.backoff.next())
+    }
+    setConnectionStatus(connected) {
+        this.dom.connection.textContent = connected ? '' : '再接続しています...'
     }
     onsubmit(event) {
         let optIdx = -1
@@ -59,17 +379,39 @@ class Match {
             if (opt.checked) { optIdx = opt.value }
         }
         console.log("idx", this.quizIdx, "answer", optIdx)
-        const ep = `/api/v1/${window.location.pathname}/submission`
-        fetch(ep, {
-            method: 'POST',
-            headers: {
-                'Authorization': this.id_token,
-            },
-            body: JSON.stringify({
-                quiz_idx: this.quizIdx,
-                option_idx: Number(optIdx),
+        this.request('submit', {
+            quiz_idx: this.quizIdx,
+            option_idx: Number(optIdx),
+        }).catch(err => this.showSubmitError(err))
+    }
+    onready(event) {
+        this.request('ready', { ready: !this.ready })
+            .then(() => {
+                this.ready = !this.ready
+                this.dom.readyBtn.classList.toggle('active', this.ready)
             })
-        })
+            .catch(err => this.showError(err))
+    }
+    onchat(event) {
+        if (event.key !== 'Enter' || this.dom.chatInput.value === '') {
+            return
+        }
+        this.request('chat', { text: this.dom.chatInput.value })
+            .then(() => { this.dom.chatInput.value = '' })
+            .catch(err => this.showError(err))
+    }
+    control(action, target) {
+        this.request('host_control', { action: action, target: target }).catch(err => this.showError(err))
+    }
+    showSubmitError(err) {
+        const dom = document.getElementById('quiz-submit-error')
+        if (dom) {
+            dom.textContent = (err && errorMessages[err.code]) || "回答を送信できませんでした"
+        }
+    }
+    showError(err) {
+        console.log("error", err)
+        alert((err && errorMessages[err.code]) || (err && err.message) || "error")
     }
 }
 
@@ -77,10 +419,8 @@ let gConn
 let gMatch
 
 const init = () => {
-    const conn = new WebSocket(wsEndpoint())
-    gConn = conn
-
-    const match = new Match(conn)
+    const match = new Match()
+    match.connect()
     gMatch = match
 
 
@@ -89,9 +429,10 @@ const init = () => {
     }
 }
 
-const wsEndpoint = () => {
-    const ws = `ws://${window.location.hostname}:9002${window.location.pathname}${window.location.search}`
-    return ws
+const th = text => {
+    const cell = document.createElement('th')
+    cell.textContent = text
+    return cell
 }
 
 const query = key => {
@@ -100,4 +441,4 @@ const query = key => {
     return found
 }
 
-window.addEventListener('load', init)
\ No newline at end of file
+window.addEventListener('load', init)
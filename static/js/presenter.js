@@ -0,0 +1,230 @@
+// 大画面用の表示. playerとしては参加せず、stateを受け取って表示するだけ
+
+// 順位表に出す人数
+const LEADERBOARD_SIZE = 10
+
+class Presenter {
+    constructor() {
+        this.dom = {}
+        this.dom.joinCode = document.getElementById('join-code')
+        this.dom.progress = document.getElementById('progress')
+        this.dom.countdown = document.getElementById('countdown')
+        this.dom.connection = document.getElementById('connection')
+        this.dom.question = document.getElementById('question')
+        this.dom.answerCount = document.getElementById('answer-count')
+        this.dom.reveal = document.getElementById('reveal')
+        this.dom.leaderboard = document.getElementById('leaderboard')
+        this.dom.teams = document.getElementById('teams')
+
+        this.conn = null
+        this.backoff = new Backoff()
+        this.state = null
+        this.version = -1
+        // 同じquizを描き直さないように覚えておく
+        this.shownQuiz = null
+
+        this.requestSeq = 0
+        this.pending = {}
+
+        this.onopen = this.onopen.bind(this)
+        this.onmessage = this.onmessage.bind(this)
+        this.onclose = this.onclose.bind(this)
+    }
+
+    connect() {
+        const conn = new WebSocket(wsEndpoint())
+        conn.onopen = this.onopen
+        conn.onmessage = this.onmessage
+        conn.onclose = this.onclose
+        this.conn = conn
+    }
+    request(type, payload) {
+        const requestID = String(++this.requestSeq)
+        return new Promise((resolve, reject) => {
+            this.pending[requestID] = { resolve, reject }
+            this.conn.send(JSON.stringify({
+                v: PROTOCOL_VERSION,
+                type: type,
+                request_id: requestID,
+                payload: payload,
+            }))
+        })
+    }
+    settle(msg) {
+        const p = this.pending[msg.request_id]
+        if (!p) {
+            return
+        }
+        delete this.pending[msg.request_id]
+        if (msg.type === 'ack') {
+            p.resolve(msg.payload)
+        } else {
+            p.reject(msg.payload)
+        }
+    }
+
+    onopen(event) {
+        this.backoff.reset()
+        this.dom.connection.textContent = ''
+        this.heartbeat = setInterval(() => this.request('heartbeat').catch(err => console.log("heartbeat", err)), HEARTBEAT_INTERVAL)
+    }
+    onmessage(event) {
+        const msg = JSON.parse(event.data)
+        switch (msg.type) {
+        case 'state':
+            this.state = msg.payload.state
+            this.version = msg.payload.version
+            this.render(this.state)
+            break
+        case 'patch':
+            // 途中のpatchを取りこぼしていたら全体を取り直す
+            if (msg.payload.base !== this.version) {
+                this.request('sync').catch(err => console.log("sync", err))
+                break
+            }
+            this.state = applyMergePatch(this.state, msg.payload.patch)
+            this.version = msg.payload.version
+            this.render(this.state)
+            break
+        case 'ack':
+        case 'error':
+            this.settle(msg)
+            break
+        }
+    }
+    onclose(event) {
+        clearInterval(this.heartbeat)
+        this.dom.connection.textContent = '再接続しています...'
+        for (const p of Object.values(this.pending)) {
+            p.reject({ code: "disconnected" })
+        }
+        this.pending = {}
+
+        setTimeout(() => this.connect(), this.backoff.next())
+    }
+
+    render(state) {
+        this.dom.joinCode.textContent = state.join_code
+        const labels = {
+            "waiting": "開始を待っています",
+            "finished": "終了しました",
+        }
+        this.dom.progress.textContent = labels[state.phase] || `${state.quiz_idx + 1} / ${state.quiz_num}問`
+        if (state.paused) {
+            this.dom.progress.textContent += ' (一時停止中)'
+        }
+        this.renderCountdown(state)
+        this.renderQuestion(state)
+        this.renderAnswerCount(state)
+        this.renderReveal(state)
+        this.renderLeaderboard(state)
+        this.renderTeams(state)
+    }
+    renderCountdown(state) {
+        clearInterval(this.countdown)
+        this.dom.countdown.textContent = ''
+        if (!state.deadline) {
+            return
+        }
+        const deadline = new Date(state.deadline)
+        const tick = () => {
+            const remaining = Math.max(0, Math.ceil((deadline - Date.now()) / 1000))
+            this.dom.countdown.textContent = `残り${remaining}秒`
+        }
+        tick()
+        this.countdown = setInterval(tick, 500)
+    }
+    renderQuestion(state) {
+        const quiz = state.phase === 'question' ? state.quiz : null
+        const key = quiz ? `${state.quiz_idx}:${quiz.answer_idx}` : null
+        if (key === this.shownQuiz) {
+            return
+        }
+        this.shownQuiz = key
+        this.dom.question.innerHTML = ''
+        if (!quiz) {
+            return
+        }
+        const content = document.createElement('div')
+        content.innerHTML = quiz.description_html
+        this.dom.question.appendChild(content)
+        const options = document.createElement('div')
+        options.className = 'options'
+        for (const opt of quiz.options) {
+            const el = document.createElement('div')
+            el.className = 'option'
+            el.textContent = opt.description
+            options.appendChild(el)
+        }
+        this.dom.question.appendChild(options)
+        if (window.PR) {
+            PR.prettyPrint()
+        }
+    }
+    renderAnswerCount(state) {
+        const c = state.answer_count
+        this.dom.answerCount.textContent = c ? `回答 ${c.answered} / ${c.players}人` : ''
+    }
+    renderReveal(state) {
+        this.dom.reveal.innerHTML = ''
+        const reveal = state.reveal
+        if (!reveal) {
+            return
+        }
+        const title = document.createElement('div')
+        title.textContent = `${reveal.quiz_idx + 1}問目の結果 正解 ${reveal.correct} / ${reveal.answered}人`
+        this.dom.reveal.appendChild(title)
+        const max = Math.max(1, ...reveal.distribution)
+        reveal.quiz.options.forEach((opt, i) => {
+            const row = document.createElement('div')
+            row.className = 'bar-row'
+            if (opt.index === reveal.quiz.answer_idx) {
+                row.classList.add('correct')
+            }
+            const label = document.createElement('div')
+            label.className = 'bar-label'
+            label.textContent = opt.description
+            const bar = document.createElement('div')
+            bar.className = 'bar'
+            bar.style.width = `${50 * reveal.distribution[i] / max}%`
+            const count = document.createElement('span')
+            count.textContent = reveal.distribution[i]
+            row.appendChild(label)
+            row.appendChild(bar)
+            row.appendChild(count)
+            this.dom.reveal.appendChild(row)
+        })
+    }
+    renderLeaderboard(state) {
+        this.dom.leaderboard.innerHTML = ''
+        for (const r of (state.leaderboard || []).slice(0, LEADERBOARD_SIZE)) {
+            this.dom.leaderboard.appendChild(rankRow(r.rank, r.team ? `${r.user.name} (${r.team})` : r.user.name, r.score))
+        }
+    }
+    renderTeams(state) {
+        this.dom.teams.innerHTML = ''
+        this.dom.teams.classList.toggle('hidden', !state.teams)
+        for (const t of (state.teams || [])) {
+            this.dom.teams.appendChild(rankRow(t.rank, t.name, t.score))
+        }
+    }
+}
+
+const rankRow = (rank, name, score) => {
+    const row = document.createElement('li')
+    for (const [className, text] of [['rank', `${rank}位`], ['name', name], ['score', `${score}点`]]) {
+        const cell = document.createElement('span')
+        cell.className = className
+        cell.textContent = text
+        row.appendChild(cell)
+    }
+    return row
+}
+
+window.addEventListener('load', () => {
+    if (!window["WebSocket"]) {
+        console.log("your browser does not support websocket.")
+        return
+    }
+    new Presenter().connect()
+})
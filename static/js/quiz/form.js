@@ -17,6 +17,7 @@ class QuizForm {
          document.getElementById('option-four-radio')
         ]
         this.dom.answerDescription = document.getElementById('answer-description')
+        this.dom.tags = document.getElementById('tags')
 
         this.id_token = query('id_token')
         this.isNew = false
@@ -35,7 +36,8 @@ class QuizForm {
                 { index: 2, description: this.dom.options[2].value, is_answer: false},
                 { index: 3, description: this.dom.options[3].value, is_answer: false},
             ],
-            "answer_description": this.dom.answerDescription.value
+            "answer_description": this.dom.answerDescription.value,
+            "tags": this.tags(),
         }
         const answerIdx = this.answerOptionIndex()
         q.options.forEach((opt, idx) => {
@@ -45,6 +47,10 @@ class QuizForm {
         return q
     }
 
+    tags() {
+        return this.dom.tags.value.split(',').map(t => t.trim()).filter(t => t !== '')
+    }
+
     answerOptionIndex() {
         const options = document.getElementsByClassName('option-radio')
         for (const opt of options) {
@@ -101,6 +107,7 @@ class QuizForm {
             radio.checked = opt.is_answer
         }
         this.dom.answerDescription.value  = q.answer_description
+        this.dom.tags.value = (q.tags || []).join(', ')
         this.quizID = q.id
     }
 
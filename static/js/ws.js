@@ -0,0 +1,44 @@
+// match.jsとpresenter.jsで共通のwebsocketまわり. どちらよりも先に読み込む
+
+// serverと合わせる
+const PROTOCOL_VERSION = 1
+const HEARTBEAT_INTERVAL = 30 * 1000
+// 再接続の間隔. 失敗するたびに倍にする
+const RECONNECT_MIN_DELAY = 1000
+const RECONNECT_MAX_DELAY = 30 * 1000
+
+// serverがhttpsならwss. originはserverから渡される
+const wsEndpoint = () => `${document.body.dataset.wsUrl}/ws${window.location.pathname}${window.location.search}`
+
+// applyMergePatch applies JSON Merge Patch (RFC 7386).
+const applyMergePatch = (target, patch) => {
+    if (patch === null || typeof patch !== 'object' || Array.isArray(patch)) {
+        return patch
+    }
+    const result = (target !== null && typeof target === 'object' && !Array.isArray(target)) ? Object.assign({}, target) : {}
+    for (const [key, value] of Object.entries(patch)) {
+        if (value === null) {
+            delete result[key]
+        } else {
+            result[key] = applyMergePatch(result[key], value)
+        }
+    }
+    return result
+}
+
+// Backoff returns delay before reconnecting.
+class Backoff {
+    constructor() {
+        this.delay = RECONNECT_MIN_DELAY
+    }
+    // 接続できたら最初の間隔に戻す
+    reset() {
+        this.delay = RECONNECT_MIN_DELAY
+    }
+    next() {
+        // jitterをいれて一斉に再接続しないようにする
+        const delay = this.delay * (0.5 + Math.random() / 2)
+        this.delay = Math.min(this.delay * 2, RECONNECT_MAX_DELAY)
+        return delay
+    }
+}
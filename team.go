@@ -0,0 +1,305 @@
+package main
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// team戦. playerはmatch内のいずれかのteamに所属し、teamごとの点数で順位を競う.
+// 合計/平均modeでは各自が回答した点数をteamで集計し、
+// 合意modeではteamで1つの回答をcaptainまたは多数決で決める.
+
+const (
+	teamModeSum       = "sum"
+	teamModeAverage   = "average"
+	teamModeConsensus = "consensus"
+
+	consensusCaptain  = "captain"  // captainの回答がteamの回答になる
+	consensusMajority = "majority" // 最も多く選ばれた選択肢がteamの回答になる
+
+	minTeams          = 2
+	maxTeams          = 10
+	maxTeamNameLength = 30
+)
+
+// validateTeams checks team settings of config.
+func (c *MatchConfig) validateTeams() error {
+	invalid := func(msg string) error {
+		return newAPIError(errCodeInvalidConfig, msg)
+	}
+	switch c.TeamMode {
+	case "":
+		if len(c.Teams) > 0 || c.ConsensusPolicy != "" {
+			return invalid("teams require team_mode")
+		}
+		return nil
+	case teamModeSum, teamModeAverage:
+		if c.ConsensusPolicy != "" {
+			return invalid("consensus_policy is only for team_mode consensus")
+		}
+	case teamModeConsensus:
+		if c.ConsensusPolicy != consensusCaptain && c.ConsensusPolicy != consensusMajority {
+			return invalid("unknown consensus_policy " + c.ConsensusPolicy)
+		}
+	default:
+		return invalid("unknown team_mode " + c.TeamMode)
+	}
+	if len(c.Teams) < minTeams || len(c.Teams) > maxTeams {
+		return invalid("teams must be 2 to 10")
+	}
+	seen := make(map[string]bool, len(c.Teams))
+	for _, name := range c.Teams {
+		if name == "" || utf8.RuneCountInString(name) > maxTeamNameLength {
+			return invalid("team name must be 1 to 30 characters")
+		}
+		if seen[name] {
+			return invalid("duplicate team " + name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+func (m *Match) isTeamMatch() bool {
+	return m.config.TeamMode != ""
+}
+
+// members returns players of the team ordered by user id.
+func (m *Match) members(team string) []*Context {
+	var members []*Context
+	for _, ctx := range m.contexts {
+		if ctx.Team == team {
+			members = append(members, ctx)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].User.ID < members[j].User.ID })
+	return members
+}
+
+// assignTeam returns team with fewest members. 同数なら設定の順.
+func (m *Match) assignTeam() string {
+	counts := make(map[string]int, len(m.config.Teams))
+	for _, ctx := range m.contexts {
+		counts[ctx.Team]++
+	}
+	best := m.config.Teams[0]
+	for _, name := range m.config.Teams[1:] {
+		if counts[name] < counts[best] {
+			best = name
+		}
+	}
+	return best
+}
+
+// setTeam moves player to team. 開始後はteamを変えられない.
+func (m *Match) setTeam(ctx *Context, team string) error {
+	if !m.isTeamMatch() {
+		return newAPIError(errCodeInvalidTeam, "match has no teams")
+	}
+	if team == "" {
+		team = m.assignTeam()
+	}
+	if !containsString(m.config.Teams, team) {
+		return newAPIError(errCodeInvalidTeam, "unknown team "+team)
+	}
+	if ctx.Team == team {
+		return nil
+	}
+	if m.status != initializing {
+		return newAPIError(errCodeInvalidTeam, "team can not be changed after start")
+	}
+	old := ctx.Team
+	ctx.Team, ctx.Captain = team, false
+	if old != "" {
+		m.electCaptain(old)
+	}
+	m.electCaptain(team)
+	return nil
+}
+
+// electCaptain makes sure team has a captain if it has members.
+// 最初に参加したplayerがcaptainになる. captainが抜けた場合はuser idの順で次を選ぶ.
+func (m *Match) electCaptain(team string) {
+	members := m.members(team)
+	for _, ctx := range members {
+		if ctx.Captain {
+			return
+		}
+	}
+	if len(members) > 0 {
+		members[0].Captain = true
+	}
+}
+
+// teamAnswer returns whose answer counts as the team's answer to the quiz.
+// 多数決の同数は、その選択肢が最初に選ばれた時刻が早い方にする.
+func (m *Match) teamAnswer(team string, quizIdx int) (*Context, bool) {
+	votes := make(map[int]int)
+	first := make(map[int]*Context)
+	for _, ctx := range m.members(team) {
+		if quizIdx >= len(ctx.Results) || !ctx.Results[quizIdx].OptionSubmitted {
+			continue
+		}
+		r := ctx.Results[quizIdx]
+		if m.config.ConsensusPolicy == consensusCaptain {
+			if ctx.Captain {
+				return ctx, true
+			}
+			continue
+		}
+		votes[r.OptionIdx]++
+		if f, found := first[r.OptionIdx]; !found || r.SubmittedAt.Before(f.Results[quizIdx].SubmittedAt) {
+			first[r.OptionIdx] = ctx
+		}
+	}
+	var chosen *Context
+	var chosenVotes int
+	for option, n := range votes {
+		c := first[option]
+		if chosen == nil || n > chosenVotes || (n == chosenVotes && c.Results[quizIdx].SubmittedAt.Before(chosen.Results[quizIdx].SubmittedAt)) {
+			chosen, chosenVotes = c, n
+		}
+	}
+	return chosen, chosen != nil
+}
+
+// teamScore returns score of the team without hiding anything. 結果の保存に使う.
+func (m *Match) teamScore(team string) int {
+	members := m.members(team)
+	switch m.config.TeamMode {
+	case teamModeConsensus:
+		var score int
+		for i := range m.quizzes {
+			if ctx, ok := m.teamAnswer(team, i); ok {
+				score += ctx.Results[i].Points
+			}
+		}
+		return score
+	default:
+		var score int
+		for _, ctx := range members {
+			score += ctx.Score()
+		}
+		return averageIfNeeded(m.config.TeamMode, score, len(members))
+	}
+}
+
+func averageIfNeeded(mode string, sum, members int) int {
+	if mode != teamModeAverage || members == 0 {
+		return sum
+	}
+	return sum / members
+}
+
+// TeamView -
+type TeamView struct {
+	Name    string        `json:"name"`
+	Members []string      `json:"members"` // user.ID
+	Captain string        `json:"captain,omitempty"`
+	Score   int           `json:"score"`
+	Rank    int           `json:"rank"`              // 同点は同じrank
+	Answers []*ResultView `json:"answers,omitempty"` // 合意modeのteamの回答
+}
+
+// teams returns team leaderboard for viewer.
+// playerの点数と同じく、viewerに見せられる結果の分だけ加算する.
+func (s *State) teams(players map[string]*PlayerView) []*TeamView {
+	m := s.match
+	if !m.isTeamMatch() {
+		return nil
+	}
+	teams := make([]*TeamView, 0, len(m.config.Teams))
+	for _, name := range m.config.Teams {
+		t := &TeamView{Name: name, Members: []string{}}
+		members := m.members(name)
+		var sum int
+		for _, ctx := range members {
+			t.Members = append(t.Members, ctx.User.ID)
+			if ctx.Captain {
+				t.Captain = ctx.User.ID
+			}
+			if p, found := players[ctx.User.ID]; found {
+				sum += p.Score
+			}
+		}
+		t.Score = averageIfNeeded(m.config.TeamMode, sum, len(members))
+		if m.config.TeamMode == teamModeConsensus {
+			t.Score = 0
+			for i := range m.quizzes {
+				ctx, ok := m.teamAnswer(name, i)
+				if !ok {
+					t.Answers = append(t.Answers, &ResultView{Status: resultUnanswered})
+					continue
+				}
+				qr := ctx.Results[i]
+				hidden := !s.canSeeChoice(ctx.User.ID, i)
+				revealed := m.resultRevealed(i)
+				t.Answers = append(t.Answers, resultView(qr, hidden, revealed))
+				if !hidden && revealed {
+					t.Score += qr.Points
+				}
+			}
+		}
+		teams = append(teams, t)
+	}
+	rankTeams(teams)
+	return teams
+}
+
+func rankTeams(teams []*TeamView) {
+	sort.SliceStable(teams, func(i, j int) bool {
+		if teams[i].Score != teams[j].Score {
+			return teams[i].Score > teams[j].Score
+		}
+		return teams[i].Name < teams[j].Name
+	})
+	for i, t := range teams {
+		t.Rank = i + 1
+		if i > 0 && teams[i-1].Score == t.Score {
+			t.Rank = teams[i-1].Rank
+		}
+	}
+}
+
+// TeamResult is final result of a team. Teamsはrank順.
+type TeamResult struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"` // user.ID
+	Score   int      `json:"score"`
+	Rank    int      `json:"rank"`
+}
+
+func (m *Match) teamResults() []*TeamResult {
+	if !m.isTeamMatch() {
+		return nil
+	}
+	views := make([]*TeamView, 0, len(m.config.Teams))
+	for _, name := range m.config.Teams {
+		t := &TeamView{Name: name, Members: []string{}, Score: m.teamScore(name)}
+		for _, ctx := range m.members(name) {
+			t.Members = append(t.Members, ctx.User.ID)
+		}
+		views = append(views, t)
+	}
+	rankTeams(views)
+	results := make([]*TeamResult, len(views))
+	for i, t := range views {
+		results[i] = &TeamResult{Name: t.Name, Members: t.Members, Score: t.Score, Rank: t.Rank}
+	}
+	return results
+}
+
+// checkTeamSubmission rejects answer which can not count for the team.
+func (m *Match) checkTeamSubmission(ctx *Context) error {
+	if m.config.TeamMode == teamModeConsensus && m.config.ConsensusPolicy == consensusCaptain && !ctx.Captain {
+		return newAPIError(errCodeNotCaptain, "only captain can answer for the team")
+	}
+	return nil
+}
+
+// sameTeam reports whether both players belong to the same team.
+func (m *Match) sameTeam(a, b string) bool {
+	ca, okA := m.contexts[a]
+	cb, okB := m.contexts[b]
+	return okA && okB && ca.Team != "" && ca.Team == cb.Team
+}
@@ -1,20 +1,35 @@
 package main
 
 import (
+	"context"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
+	"cloud.google.com/go/datastore"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ymgyt/appkit/handlers"
 	"github.com/ymgyt/appkit/services"
+	"go.uber.org/zap"
 )
 
 // User -
 type User struct {
+	ID        string `json:"id"` // provider:provider上のid. loginは変更できるのでこちらで識別する
 	Name      string `json:"name"`
 	AvatarURL string `json:"avatar_url"`
 }
 
+const (
+	userKind       = "User"
+	providerGithub = "github"
+)
+
 // AnonymouseUser -
 var AnonymouseUser = &User{
+	ID:        "anonymous",
 	Name:      "noone",
 	AvatarURL: "https://avatars2.githubusercontent.com/u/38001821?s=400&v=4", // 誰かのdefault icon
 }
@@ -26,11 +41,22 @@ func UserFromMapClaims(c map[string]interface{}) *User {
 		return AnonymouseUser
 	}
 	return &User{
+		ID:        userIDFromClaims(c),
 		Name:      name,
 		AvatarURL: c["avatar_url"].(string),
 	}
 }
 
+// userIDFromClaims returns user id. idを含まない古いtokenでは空になる.
+func userIDFromClaims(c map[string]interface{}) string {
+	// jsonの数値なのでfloat64になっている
+	id, ok := c["id"].(float64)
+	if !ok {
+		return ""
+	}
+	return providerGithub + ":" + strconv.FormatInt(int64(id), 10)
+}
+
 // UserFromReq -
 func UserFromReq(r *http.Request) (u *User, found bool) {
 	ctx := r.Context()
@@ -40,3 +66,181 @@ func UserFromReq(r *http.Request) (u *User, found bool) {
 	}
 	return UserFromMapClaims(idToken.Claims.(jwt.MapClaims)), true
 }
+
+// UserProfile is persisted user.
+type UserProfile struct {
+	ID          string    `json:"id" datastore:"-"` // keyのname
+	Provider    string    `json:"provider"`
+	Login       string    `json:"login"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url" datastore:",noindex"`
+	JoinedAt    time.Time `json:"joined_at"`
+	QuizCount   int       `json:"quiz_count"` // 作成したquizの数
+	MatchCount  int       `json:"match_count"`
+	Answered    int       `json:"answered"`
+	Correct     int       `json:"correct"`
+	Accuracy    float64   `json:"accuracy" datastore:"-"`
+	Rating      float64   `json:"rating"` // Elo rating
+	Rated       int       `json:"rated"`  // ratingに反映した回答数
+	// daily challengeを連続で解いた日数
+	DailyStreak        int    `json:"daily_streak"`
+	LongestDailyStreak int    `json:"longest_daily_streak"`
+	LastDailyDate      string `json:"last_daily_date"`
+}
+
+func (p *UserProfile) derive() {
+	if p.Rated == 0 {
+		p.Rating = initialRating
+	}
+	if p.Answered > 0 {
+		p.Accuracy = float64(p.Correct) / float64(p.Answered)
+	}
+	// 昨日も今日も解いていなければ途切れている
+	today := time.Now()
+	if p.LastDailyDate != dailyDate(today) && p.LastDailyDate != dailyDate(today.AddDate(0, 0, -1)) {
+		p.DailyStreak = 0
+	}
+}
+
+// RecordDaily updates streak by daily challenge finished on date.
+func (uh *UserHandler) RecordDaily(ctx context.Context, user *User, date string) error {
+	return uh.update(ctx, user.ID, func(p *UserProfile) {
+		// 日付をまたいだ挑戦が後から記録されても、新しい日付のstreakは戻さない
+		if p.LastDailyDate >= date {
+			return
+		}
+		t, err := time.ParseInLocation(dailyDateLayout, date, dailyLocation)
+		if err == nil && p.LastDailyDate == dailyDate(t.AddDate(0, 0, -1)) {
+			p.DailyStreak++
+		} else {
+			p.DailyStreak = 1
+		}
+		if p.DailyStreak > p.LongestDailyStreak {
+			p.LongestDailyStreak = p.DailyStreak
+		}
+		p.LastDailyDate = date
+	})
+}
+
+// UserHandler -
+type UserHandler struct {
+	ts          *handlers.TemplateSet
+	datastore   *datastore.Client
+	logger      *zap.Logger
+	leaderboard *Leaderboard
+}
+
+// Upsert records user who logged in. 初回ならJoinedAtを記録する.
+func (uh *UserHandler) Upsert(ctx context.Context, user *User, displayName string) error {
+	return uh.update(ctx, user.ID, func(p *UserProfile) {
+		p.Login = user.Name
+		p.DisplayName = displayName
+		if p.DisplayName == "" {
+			p.DisplayName = user.Name
+		}
+		p.AvatarURL = user.AvatarURL
+	})
+}
+
+// RecordQuiz counts quiz the user authored.
+func (uh *UserHandler) RecordQuiz(ctx context.Context, user *User) error {
+	err := uh.update(ctx, user.ID, func(p *UserProfile) {
+		p.QuizCount++
+	})
+	if err != nil {
+		return err
+	}
+	return uh.leaderboard.RecordQuiz(ctx, user)
+}
+
+// RecordMatch adds match result to profile of each player.
+func (uh *UserHandler) RecordMatch(ctx context.Context, res *MatchResult) error {
+	for _, player := range res.Players {
+		err := uh.update(ctx, player.User.ID, func(p *UserProfile) {
+			p.MatchCount++
+			for _, s := range player.Submissions {
+				if !s.Submitted {
+					continue
+				}
+				p.Answered++
+				if s.Correct {
+					p.Correct++
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return uh.leaderboard.RecordMatch(ctx, res)
+}
+
+func (uh *UserHandler) update(ctx context.Context, userID string, f func(p *UserProfile)) error {
+	k := datastore.NameKey(userKind, userID, nil)
+	_, err := uh.datastore.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var p UserProfile
+		err := tx.Get(k, &p)
+		if err == datastore.ErrNoSuchEntity {
+			p.Provider = providerGithub
+			p.JoinedAt = time.Now()
+		} else if err != nil {
+			return err
+		}
+		f(&p)
+		_, err = tx.Put(k, &p)
+		return err
+	})
+	return err
+}
+
+// Fetch -
+func (uh *UserHandler) Fetch(ctx context.Context, userID string) (*UserProfile, error) {
+	var p UserProfile
+	if err := uh.datastore.Get(ctx, datastore.NameKey(userKind, userID, nil), &p); err != nil {
+		return nil, err
+	}
+	p.ID = userID
+	p.derive()
+	return &p, nil
+}
+
+// Get returns user profile.
+func (uh *UserHandler) Get(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	p, err := uh.Fetch(r.Context(), params.ByName("id"))
+	if err == datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		uh.logger.Error("fetch user", zap.Error(err))
+		fail(w, http.StatusInternalServerError, &apiResponse{})
+		return
+	}
+	(&apiResponse{Data: p}).write(w)
+}
+
+// RenderProfile -
+func (uh *UserHandler) RenderProfile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	p, err := uh.Fetch(r.Context(), params.ByName("id"))
+	if err == datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		uh.logger.Error("fetch user", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = uh.ts.ExecuteTemplate(w, "user", struct {
+		Profile     *UserProfile
+		AccuracyPct int
+		Rating      int
+	}{
+		Profile:     p,
+		AccuracyPct: int(p.Accuracy * 100),
+		Rating:      int(math.Round(p.Rating)),
+	})
+	if err != nil {
+		uh.logger.Error("render user", zap.Error(err))
+	}
+}